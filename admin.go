@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// resolveRequest is the body of POST /api/resolve.
+type resolveRequest struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// resolveResponse carries the handler's reply in wire format, so clients
+// can print it exactly as a DNS client would.
+type resolveResponse struct {
+	Message []byte `json:"message"`
+}
+
+// serveAdmin serves the admin API on the Unix socket at path, readable and
+// writable by the owner only.
+func (s *DNSServer) serveAdmin(path string) {
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("Error listening on admin socket %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		log.Fatalf("Error setting admin socket permissions: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/resolve", s.handleAPIResolve)
+	mux.HandleFunc("GET /api/conflicts", s.handleAPIConflicts)
+	mux.HandleFunc("GET /api/version", handleAPIVersion)
+
+	log.Printf("Serving admin API on %s", path)
+	log.Fatal(http.Serve(ln, mux))
+}
+
+// handleAPIResolve runs a query through the DNS request handler without
+// going over the network and returns the reply.
+func (s *DNSServer) handleAPIResolve(w http.ResponseWriter, r *http.Request) {
+	var req resolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(req.Type)]
+	if !ok || req.Name == "" {
+		http.Error(w, "name and a known record type are required", http.StatusBadRequest)
+		return
+	}
+
+	q := new(dns.Msg)
+	q.SetQuestion(dns.Fqdn(req.Name), qtype)
+	cw := &captureWriter{}
+	s.handleDNSRequest(cw, q)
+	if cw.msg == nil {
+		http.Error(w, "query was dropped", http.StatusBadGateway)
+		return
+	}
+	packed, err := cw.msg.Pack()
+	if err != nil {
+		http.Error(w, "packing response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, resolveResponse{Message: packed})
+}
+
+// runQuery implements the "query" subcommand, resolving a name through a
+// running proxy's admin socket and printing the reply like dig.
+func runQuery(args []string) {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	name := fs.String("name", "", "Name to resolve")
+	qtype := fs.String("type", "A", "Record type to query")
+	server := fs.String("server", "/var/run/tsmagicproxy.sock", "Admin socket of the running proxy")
+	fs.Parse(args)
+	if *name == "" {
+		fmt.Fprintln(os.Stderr, "query: -name is required")
+		os.Exit(2)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", *server)
+		},
+	}}
+	body, _ := json.Marshal(resolveRequest{Name: *name, Type: *qtype})
+	resp, err := client.Post("http://tsmagicproxy/api/resolve", "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Fatalf("Error querying %s: %v", *server, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		log.Fatalf("Query failed: %s: %s", resp.Status, strings.TrimSpace(msg.String()))
+	}
+
+	var result resolveResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Fatalf("Error decoding response: %v", err)
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(result.Message); err != nil {
+		log.Fatalf("Error unpacking DNS message: %v", err)
+	}
+	fmt.Println(m)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// axfrChunkSize is the number of records sent per AXFR message, keeping each
+// message well under the 64 KiB TCP limit.
+const axfrChunkSize = 100
+
+// zoneSerial tracks the SOA serial of the tailnet zone, advancing it
+// whenever the zone's records change, and keeps recent versions of the
+// zone for IXFR.
+type zoneSerial struct {
+	mu      sync.Mutex
+	serial  uint32
+	hash    [sha256.Size]byte
+	history zoneHistory
+}
+
+// update returns the serial for records, bumping it if they differ from
+// the records seen on the previous call.
+func (z *zoneSerial) update(records []dns.RR) uint32 {
+	h := sha256.New()
+	for _, rr := range records {
+		h.Write([]byte(rr.String()))
+		h.Write([]byte{'\n'})
+	}
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.serial == 0 {
+		z.serial = uint32(time.Now().Unix())
+		z.history.add(z.serial, records)
+	} else if sum != z.hash {
+		z.serial++
+		z.history.add(z.serial, records)
+	}
+	z.hash = sum
+	return z.serial
+}
+
+// snapshot returns the zone records as of serial, if still in the history.
+func (z *zoneSerial) snapshot(serial uint32) ([]dns.RR, bool) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.history.get(serial)
+}
+
+// handleAXFR answers a zone transfer request for the configured domain with
+// the SOA, the apex NS, the A and AAAA records of this node and every peer,
+// and the closing SOA.
+func (s *DNSServer) handleAXFR(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.transferAllowed(w, r, true) {
+		return
+	}
+
+	status, err := s.fetchStatus()
+	if err != nil {
+		log.Printf("Error getting status: %v", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+
+	records := zoneRecords(status, s.domain, *ttl)
+	soa := s.soaRecord(status, records)
+	s.sendAXFR(w, r, soa, records)
+}
+
+// sendAXFR streams a full transfer of records framed by soa.
+func (s *DNSServer) sendAXFR(w dns.ResponseWriter, r *dns.Msg, soa *dns.SOA, records []dns.RR) {
+	log.Printf("AXFR of %s to %s: serial %d, %d records", r.Question[0].Name, w.RemoteAddr(), soa.Serial, len(records))
+
+	rrs := append(zoneContents(soa, records), soa)
+	if streamTransfer(w, r, rrs) {
+		metricAXFRTransfers.Add(1)
+	}
+}
+
+// transferAllowed checks a zone transfer request, answering it with an
+// error and returning false if it is refused. TCP is required for AXFR
+// only, as IXFR may be tried over UDP first.
+func (s *DNSServer) transferAllowed(w dns.ResponseWriter, r *dns.Msg, requireTCP bool) bool {
+	q := r.Question[0]
+	kind := dns.TypeToString[q.Qtype]
+	m := new(dns.Msg)
+	m.SetReply(r)
+
+	client, _ := netip.ParseAddrPort(w.RemoteAddr().String())
+	if _, ok := w.RemoteAddr().(*net.TCPAddr); !ok && requireTCP {
+		log.Printf("Refusing %s from %s over UDP", kind, client.Addr())
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return false
+	}
+	if !s.axfrAllowed(client.Addr().Unmap()) {
+		log.Printf("Refusing %s from %s: not in -axfr-allow-from", kind, client.Addr())
+		m.Rcode = dns.RcodeRefused
+		addExtendedError(m, dns.ExtendedErrorCodeProhibited, "zone transfers are not allowed from this address")
+		w.WriteMsg(m)
+		return false
+	}
+	if s.domain == "" || !strings.EqualFold(dns.Fqdn(s.domain), q.Name) {
+		log.Printf("Refusing %s for %s: not the configured domain", kind, q.Name)
+		m.Rcode = dns.RcodeNotAuth
+		w.WriteMsg(m)
+		return false
+	}
+	return true
+}
+
+// streamTransfer sends rrs as a multi-message zone transfer response and
+// reports whether it completed.
+func streamTransfer(w dns.ResponseWriter, r *dns.Msg, rrs []dns.RR) bool {
+	ch := make(chan *dns.Envelope)
+	tr := new(dns.Transfer)
+	errc := make(chan error, 1)
+	go func() { errc <- tr.Out(w, r, ch) }()
+	for chunk := range slices.Chunk(rrs, axfrChunkSize) {
+		ch <- &dns.Envelope{RR: chunk}
+	}
+	close(ch)
+	if err := <-errc; err != nil {
+		log.Printf("Zone transfer to %s failed: %v", w.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
+// axfrAllowed reports whether addr may request zone transfers.
+func (s *DNSServer) axfrAllowed(addr netip.Addr) bool {
+	for _, p := range s.axfrAllowFrom {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// soaRecord builds the SOA record for the configured domain, with the serial
+// advanced if records differ from the last zone built.
+func (s *DNSServer) soaRecord(status *ipnstate.Status, records []dns.RR) *dns.SOA {
+	zone := dns.Fqdn(s.domain)
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(*ttl),
+		},
+		Ns:      dns.Fqdn(status.Self.DNSName),
+		Mbox:    "hostmaster." + zone,
+		Serial:  s.serial.update(records),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  uint32(*ttl),
+	}
+}
+
+// zoneRecords returns the A and AAAA records of this node and every peer
+// under domain, sorted so the zone is stable across calls. Reverse names lie
+// outside the zone, so PTR records are left to -owned-zones.
+func zoneRecords(status *ipnstate.Status, domain string, ttl int) []dns.RR {
+	domain = strings.ToLower(domain)
+	var records []dns.RR
+	for _, peer := range peersAndSelf(status) {
+		if peer.DNSName == "" || !dnsname.HasSuffix(strings.ToLower(peer.DNSName), domain) {
+			continue
+		}
+		name := dns.Fqdn(peer.DNSName)
+		for _, addr := range peer.TailscaleIPs {
+			if rr := createRR(name, addr, ttl); rr != nil {
+				records = append(records, rr)
+			}
+		}
+	}
+	slices.SortFunc(records, func(a, b dns.RR) int {
+		return strings.Compare(a.String(), b.String())
+	})
+	return records
+}
+
+// zoneContents returns the whole zone: the SOA, the apex NS naming this
+// node, which the SOA names as primary, and records. Secondaries reject a
+// zone without an apex NS RRset.
+func zoneContents(soa *dns.SOA, records []dns.RR) []dns.RR {
+	ns := &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   soa.Hdr.Name,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    soa.Hdr.Ttl,
+		},
+		Ns: soa.Ns,
+	}
+	rrs := make([]dns.RR, 0, len(records)+3)
+	rrs = append(rrs, soa, ns)
+	return append(rrs, records...)
+}
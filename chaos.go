@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// handleCHAOS answers CHAOS class TXT queries identifying the server:
+// version.bind, hostname.bind and id.server. Other CHAOS names are refused.
+func (s *DNSServer) handleCHAOS(q dns.Question, m *dns.Msg) {
+	m.Authoritative = false
+
+	var txt string
+	switch strings.ToLower(q.Name) {
+	case "version.bind.", "version.server.":
+		txt = "tsmagicproxy"
+		if *exposeVersion {
+			txt += " " + version
+		}
+	case "hostname.bind.":
+		txt = *hostname
+	case "id.server.":
+		txt = *serverID
+		if txt == "" {
+			txt = *hostname
+		}
+	default:
+		m.Rcode = dns.RcodeRefused
+		return
+	}
+	if q.Qtype != dns.TypeTXT && q.Qtype != dns.TypeANY {
+		return
+	}
+
+	m.Answer = append(m.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassCHAOS,
+		},
+		Txt: []string{txt},
+	})
+}
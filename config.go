@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"tailscale.com/util/dnsname"
+)
+
+// validateConfig checks the parsed flags without touching the network and
+// returns every problem found, so they can all be reported at once.
+func validateConfig() []error {
+	var errs []error
+
+	if *authKey == "" && *staticPeersFile == "" {
+		errs = append(errs, errors.New("auth key must be provided via -authkey flag or TS_AUTHKEY environment variable"))
+	}
+	if err := dnsname.ValidLabel(*hostname); err != nil {
+		errs = append(errs, fmt.Errorf("-hostname: %w", err))
+	}
+	if *stateDir == "" {
+		errs = append(errs, errors.New("-state-dir must not be empty"))
+	}
+	if err := validateListenAddr(*listen); err != nil {
+		errs = append(errs, fmt.Errorf("-listen: %w", err))
+	}
+	if *listen4 != "" {
+		if err := validateFamilyAddr(*listen4, "4"); err != nil {
+			errs = append(errs, fmt.Errorf("-listen-ipv4: %w", err))
+		}
+	}
+	if *listen6 != "" {
+		if err := validateFamilyAddr(*listen6, "6"); err != nil {
+			errs = append(errs, fmt.Errorf("-listen-ipv6: %w", err))
+		}
+	}
+	if *tailscaleOnly && (*listen4 != "" || *listen6 != "") {
+		errs = append(errs, errors.New("-tailscale-only uses the port of -listen and cannot be combined with -listen-ipv4 or -listen-ipv6"))
+	}
+	if *logFormat != "text" && *logFormat != "json" {
+		errs = append(errs, fmt.Errorf("-log-format %q must be text or json", *logFormat))
+	}
+	if *ttl < 0 || *ttl > math.MaxInt32 {
+		errs = append(errs, fmt.Errorf("-ttl %d is out of range [0, %d]", *ttl, math.MaxInt32))
+	}
+	if *domain != "" {
+		if _, err := dnsname.ToFQDN(*domain); err != nil {
+			errs = append(errs, fmt.Errorf("-domain: %w", err))
+		}
+	}
+	for _, d := range splitList(*domains) {
+		if _, err := dnsname.ToFQDN(d); err != nil {
+			errs = append(errs, fmt.Errorf("-domains: %w", err))
+		}
+	}
+	if *sharedDomain != "" {
+		if _, err := dnsname.ToFQDN(*sharedDomain); err != nil {
+			errs = append(errs, fmt.Errorf("-shared-peer-domain: %w", err))
+		}
+	}
+	upstreams, tlsUpstreams := parseUpstreams(*upstream, *upstreamTLS)
+	encrypted := len(tlsUpstreams) > 0
+	for _, addr := range upstreams {
+		encrypted = encrypted || isDoHUpstream(addr)
+		if err := validateUpstream(addr); err != nil {
+			errs = append(errs, fmt.Errorf("-upstream: %w", err))
+		}
+	}
+	if *qnameMinimize && encrypted {
+		errs = append(errs, errors.New("-qname-minimize queries nameservers directly and cannot use DNS-over-TLS or DNS-over-HTTPS upstreams"))
+	}
+	if *dohTimeout < 1 {
+		errs = append(errs, fmt.Errorf("-upstream-http-timeout %d must be at least 1 second", *dohTimeout))
+	}
+	switch outOfZonePolicy(*outOfZone, *upstream) {
+	case policyRefused, policyNXDomain, policyServFail:
+	case policyForward:
+		if *upstream == "" {
+			errs = append(errs, errors.New("-out-of-zone=forward requires -upstream"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("-out-of-zone %q must be one of refused, nxdomain, servfail or forward", *outOfZone))
+	}
+	// No port is open on every kind of peer, so rather than assume SSH
+	// and drop everything else, -probe-peers needs to be told which
+	if *probePeers && *probePort == 0 {
+		errs = append(errs, errors.New("-probe-peers requires -probe-port"))
+	} else if *probePort < 0 || *probePort > 65535 {
+		errs = append(errs, fmt.Errorf("-probe-port %d is out of range [1, 65535]", *probePort))
+	}
+	if *probeTTL < 2 {
+		errs = append(errs, fmt.Errorf("-probe-ttl %d must be at least 2 seconds", *probeTTL))
+	}
+	if *dryRun && *dryRunQueries == "" {
+		errs = append(errs, errors.New("-dry-run requires -dry-run-queries"))
+	}
+	if _, err := parseWebhookEvents(*webhookEvents); err != nil {
+		errs = append(errs, fmt.Errorf("-webhook-events: %w", err))
+	}
+	if *webhookTimeout < 1 {
+		errs = append(errs, fmt.Errorf("-webhook-timeout %d must be at least 1 second", *webhookTimeout))
+	}
+	if *healthInterval < 1 {
+		errs = append(errs, fmt.Errorf("-health-check-interval %d must be at least 1 second", *healthInterval))
+	}
+	if *healthTimeout < 1 {
+		errs = append(errs, fmt.Errorf("-health-check-timeout %d must be at least 1 second", *healthTimeout))
+	}
+	if *healthThreshold < 1 {
+		errs = append(errs, fmt.Errorf("-health-check-threshold %d must be at least 1", *healthThreshold))
+	}
+	if _, err := parseSocketMode(*unixSocketMode); err != nil {
+		errs = append(errs, fmt.Errorf("-unix-socket-mode: %w", err))
+	}
+	if *maxQueries < 0 {
+		errs = append(errs, fmt.Errorf("-max-concurrent-queries %d must not be negative", *maxQueries))
+	}
+	if *queueTimeout < 0 {
+		errs = append(errs, fmt.Errorf("-queue-timeout %d must not be negative", *queueTimeout))
+	}
+	if *authKeyURL != "" {
+		if u, err := url.Parse(*authKeyURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("-authkey-refresh-url %q must be an http or https URL", *authKeyURL))
+		}
+	}
+	if *keyExpiryAlert < 1 {
+		errs = append(errs, fmt.Errorf("-key-expiry-alert-interval %d must be at least 1 second", *keyExpiryAlert))
+	}
+	if *connectRetries < -1 {
+		errs = append(errs, fmt.Errorf("-connect-retries %d must be -1 (forever) or more", *connectRetries))
+	}
+	if *connectInterval < 1 {
+		errs = append(errs, fmt.Errorf("-connect-retry-interval %d must be at least 1 second", *connectInterval))
+	}
+	if *nxAlertThreshold < 0 {
+		errs = append(errs, fmt.Errorf("-nxdomain-alert-threshold %d must not be negative", *nxAlertThreshold))
+	}
+	if *nxAlertWindow < 1 {
+		errs = append(errs, fmt.Errorf("-nxdomain-alert-window %d must be at least 1 second", *nxAlertWindow))
+	}
+	if *testLatency < 0 || *testJitter < 0 {
+		errs = append(errs, errors.New("-test-latency and -test-latency-jitter must not be negative"))
+	}
+	if *testLatencyRate < 0 || *testLatencyRate > 1 {
+		errs = append(errs, fmt.Errorf("-test-latency-rate %v must be between 0.0 and 1.0", *testLatencyRate))
+	}
+	if *departedGrace < 0 {
+		errs = append(errs, fmt.Errorf("-departed-grace %d must not be negative", *departedGrace))
+	}
+	if *statusInterval < 0 {
+		errs = append(errs, fmt.Errorf("-status-log-interval %d must not be negative", *statusInterval))
+	}
+	if *rpzFile != "" && *rpzURL != "" {
+		errs = append(errs, errors.New("-rpz-file and -rpz-url are mutually exclusive"))
+	}
+	if *rpzURL != "" {
+		if u, err := url.Parse(*rpzURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("-rpz-url %q must be an http or https URL", *rpzURL))
+		}
+	}
+	if *rpzRefresh < 1 {
+		errs = append(errs, fmt.Errorf("-rpz-refresh %d must be at least 1 second", *rpzRefresh))
+	}
+	if *rrlRate < 0 {
+		errs = append(errs, fmt.Errorf("-rrl-rate %d must not be negative", *rrlRate))
+	}
+	if *rrlWindow < 1 {
+		errs = append(errs, fmt.Errorf("-rrl-window %d must be at least 1 second", *rrlWindow))
+	}
+	if *rrlPrefixLen < 1 || *rrlPrefixLen > 32 {
+		errs = append(errs, fmt.Errorf("-rrl-prefix-len %d must be between 1 and 32", *rrlPrefixLen))
+	}
+	if *staticPeersFile != "" {
+		// These need a tailnet connection
+		for _, f := range []struct {
+			name string
+			set  bool
+		}{
+			{"-tailscale-only", *tailscaleOnly},
+			{"-webui-addr", *webuiAddr != ""},
+			{"-probe-peers", *probePeers},
+			{"-health-check", len(healthCheckFlags) > 0},
+			{"-auto-srv", *autoSRV},
+			{"-auto-https-hints", *autoHTTPSHints},
+			{"-magicdns-passthrough", *passthrough},
+			{"-authkey-refresh-url", *authKeyURL != ""},
+			{"-connect-retries", *connectRetries != 0},
+			{"-serve-during-reconnect", *serveReconnect},
+		} {
+			if f.set {
+				errs = append(errs, fmt.Errorf("%s cannot be used with -static-peers-file", f.name))
+			}
+		}
+		if _, err := loadStaticStatus(*staticPeersFile); err != nil {
+			errs = append(errs, fmt.Errorf("-static-peers-file: %w", err))
+		}
+	}
+	if *peerServeConfig != "" {
+		if !*autoSRV {
+			errs = append(errs, errors.New("-peer-serve-config-file requires -auto-srv"))
+		}
+		if _, err := loadPeerServeConfigs(*peerServeConfig); err != nil {
+			errs = append(errs, fmt.Errorf("-peer-serve-config-file: %w", err))
+		}
+	}
+	if _, err := parsePrefixList(*excludeIPs); err != nil {
+		errs = append(errs, fmt.Errorf("-exclude-ips: %w", err))
+	}
+	if _, err := parsePrefixList(*includeOnlyIPs); err != nil {
+		errs = append(errs, fmt.Errorf("-include-only-ips: %w", err))
+	}
+	if m := strings.ToLower(*shortNameMode); m != conflictPick && m != conflictServFail {
+		errs = append(errs, fmt.Errorf("-short-name-conflicts %q must be pick or servfail", *shortNameMode))
+	}
+	if !validIPType(strings.ToLower(*ipType)) {
+		errs = append(errs, fmt.Errorf("-ip-type %q must be ipv4, ipv6 or both", *ipType))
+	}
+	if !validIPSelect(strings.ToLower(*ipSelect)) {
+		errs = append(errs, fmt.Errorf("-ip-select %q must be all, first, last or random", *ipSelect))
+	}
+	if _, err := parseOwnedZones(*ownedZones); err != nil {
+		errs = append(errs, fmt.Errorf("-owned-zones: %w", err))
+	}
+	if _, err := parseTagZones(*tagZoneList); err != nil {
+		errs = append(errs, fmt.Errorf("-tag-zones: %w", err))
+	}
+	if *ixfrHistory < 0 {
+		errs = append(errs, fmt.Errorf("-ixfr-history-size %d must not be negative", *ixfrHistory))
+	}
+	if _, err := parsePrefixList(*axfrAllowFrom); err != nil {
+		errs = append(errs, fmt.Errorf("-axfr-allow-from: %w", err))
+	}
+	if f := strings.ToLower(*zoneFileFormat); f != "bind" && f != "json" {
+		errs = append(errs, fmt.Errorf("-zone-file-format %q must be bind or json", *zoneFileFormat))
+	}
+	for _, addr := range upstreamList(*notifyAddrs) {
+		if err := validateListenAddr(addr); err != nil {
+			errs = append(errs, fmt.Errorf("-notify-secondaries: %w", err))
+		}
+	}
+	if *metricsAddr != "" {
+		if err := validateListenAddr(*metricsAddr); err != nil {
+			errs = append(errs, fmt.Errorf("-metrics-addr: %w", err))
+		}
+	}
+	if *webuiAddr != "" {
+		if err := validateListenAddr(*webuiAddr); err != nil {
+			errs = append(errs, fmt.Errorf("-webui-addr: %w", err))
+		}
+	}
+	if *statsdAddr != "" {
+		if err := validateListenAddr(*statsdAddr); err != nil {
+			errs = append(errs, fmt.Errorf("-statsd-addr: %w", err))
+		}
+	}
+	if *statsdInterval < 1 {
+		errs = append(errs, fmt.Errorf("-statsd-interval %d must be at least 1 second", *statsdInterval))
+	}
+
+	return errs
+}
+
+// validateListenAddr checks that addr is a host:port pair with a port in
+// the range 1-65535.
+func validateListenAddr(addr string) error {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("port %d is out of range [1, 65535]", port)
+	}
+	return nil
+}
+
+// validateUpstream checks an upstream as returned by parseUpstreams: a
+// DNS-over-HTTPS URL or a host:port address.
+func validateUpstream(addr string) error {
+	if isDoHUpstream(addr) {
+		if u, err := url.Parse(addr); err != nil || u.Host == "" {
+			return fmt.Errorf("%q is not a valid URL", addr)
+		}
+		return nil
+	}
+	return validateListenAddr(addr)
+}
+
+// validateFamilyAddr checks that addr is a valid listen address whose host,
+// if given, is an IP address of the given family ("4" or "6").
+func validateFamilyAddr(addr, family string) error {
+	if err := validateListenAddr(addr); err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if host == "" {
+		return nil
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("host %q is not an IP address", host)
+	}
+	if (family == "4") != ip.Is4() {
+		return fmt.Errorf("%s is not an IPv%s address", ip, family)
+	}
+	return nil
+}
+
+// flagWasSet reports whether the named flag was given on the command line.
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			out = append(out, field)
+		}
+	}
+	return out
+}
+
+// domainList combines the primary -domain with the -domains list, dropping
+// duplicates and keeping the primary first.
+func domainList(primary, extra string) []string {
+	var out []string
+	for _, d := range append([]string{primary}, splitList(extra)...) {
+		d = strings.Trim(d, ".")
+		if d != "" && !slices.Contains(out, d) {
+			out = append(out, d)
+		}
+	}
+	return out
+}
+
+// parsePrefixList parses a comma-separated list of IP addresses and CIDR
+// prefixes. Bare addresses are treated as single-host prefixes.
+func parsePrefixList(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range splitList(s) {
+		if strings.Contains(field, "/") {
+			p, err := netip.ParsePrefix(field)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// mustParsePrefixList is like parsePrefixList but for flags that have
+// already passed validateConfig.
+func mustParsePrefixList(s string) []netip.Prefix {
+	prefixes, err := parsePrefixList(s)
+	if err != nil {
+		panic(err)
+	}
+	return prefixes
+}
+
+// nameResolutionHelp ends the -help output, explaining how a query name is
+// matched to a peer.
+const nameResolutionHelp = `
+Name resolution:
+  A query name is matched to a peer in this order:
+    1. The peer's full MagicDNS name (web.tailnet.ts.net)
+    2. A -tag-zones zone: web.prod.internal with tag:web-prod=prod.internal
+       matches the peer named web carrying tag:web-prod
+    3. The peer's base name, alone or under -domain or -domains (web)
+  When several peers match at one step, -short-name-conflicts decides: pick
+  prefers a peer under -domain, then an online peer, then the lowest
+  Tailscale IP; servfail answers SERVFAIL.
+`
+
+// printUsage prints the flags and how names are resolved, for -help.
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(out, nameResolutionHelp)
+}
+
+// printConfigSummary prints the effective flag values followed by any
+// validation errors, for use by -validate-config.
+func printConfigSummary(errs []error) {
+	fmt.Println("Configuration:")
+	flag.VisitAll(func(f *flag.Flag) {
+		fmt.Printf("  %s = %s\n", f.Name, flagValue(f))
+	})
+
+	if len(errs) == 0 {
+		fmt.Println("Configuration is valid")
+		return
+	}
+	fmt.Printf("Found %d configuration error(s):\n", len(errs))
+	for _, err := range errs {
+		fmt.Printf("  %v\n", err)
+	}
+}
+
+// logConfigSummary logs the effective flag values as a single structured
+// event, with keys in snake_case (e.g., listen_ipv4).
+func logConfigSummary(ctx context.Context) {
+	var attrs []any
+	flag.VisitAll(func(f *flag.Flag) {
+		attrs = append(attrs, slog.String(strings.ReplaceAll(f.Name, "-", "_"), flagValue(f)))
+	})
+	slog.InfoContext(ctx, "startup configuration", attrs...)
+}
+
+// flagValue returns the value of f for display, with secrets redacted.
+func flagValue(f *flag.Flag) string {
+	value := f.Value.String()
+	switch {
+	case f.Name == "authkey" && value != "":
+		return "<redacted>"
+	case f.Name == "webhook-url" && value != "":
+		urls := strings.Split(value, ",")
+		for i, u := range urls {
+			urls[i] = redactWebhookURL(u)
+		}
+		return strings.Join(urls, ",")
+	}
+	return redactURLs(value)
+}
+
+// redactURLs redacts the userinfo and query string of the URLs in a flag
+// value, either of which may carry a token (e.g., -authkey-refresh-url or
+// an https:// -upstream). Lists are redacted entry by entry.
+func redactURLs(value string) string {
+	entries := strings.Split(value, ",")
+	for i, entry := range entries {
+		u, err := url.Parse(strings.TrimSpace(entry))
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.User == nil && u.RawQuery == "") {
+			continue
+		}
+		if u.User != nil {
+			u.User = url.User("redacted")
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = "redacted"
+		}
+		entries[i] = u.String()
+	}
+	return strings.Join(entries, ",")
+}
+
+// setupLogging installs the -log-format handler as the default logger, which
+// log.Printf output also goes through.
+func setupLogging(format string) {
+	if format == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, nil)))
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// Policies for base names shared by several peers, set by
+// -short-name-conflicts.
+const (
+	conflictPick     = "pick"
+	conflictServFail = "servfail"
+)
+
+// shortNameConflict is a base name shared by several peers, as listed by
+// GET /api/conflicts.
+type shortNameConflict struct {
+	Name  string   `json:"name"`
+	Peers []string `json:"peers"`
+}
+
+// ambiguousPeers returns the peers qname matches by base name if there is
+// more than one and none matches it by full name, and nil otherwise.
+func (s *DNSServer) ambiguousPeers(status *ipnstate.Status, qname string) []*ipnstate.PeerStatus {
+	if d := strings.ToLower(s.sharedDomain); d != "" && dnsname.HasSuffix(strings.ToLower(qname), d) {
+		return nil
+	}
+	exact, candidates := s.matchPeers(status, qname)
+	if exact == nil && len(candidates) == 0 {
+		candidates = s.taggedPeers(status, qname)
+	}
+	if exact != nil || len(candidates) < 2 {
+		return nil
+	}
+	return candidates
+}
+
+// shortNameConflicts returns every base name that matches more than one
+// node, sorted by name. The proxy itself is included, as base names resolve
+// to it too.
+func (s *DNSServer) shortNameConflicts(status *ipnstate.Status) []shortNameConflict {
+	byName := make(map[string][]string)
+	for _, peer := range peersAndSelf(status) {
+		// Shared peers are only matched in their own zone when one is set
+		if peer.DNSName == "" || (peer.ShareeNode && s.sharedDomain != "") {
+			continue
+		}
+		base := strings.ToLower(dnsname.FirstLabel(peer.DNSName))
+		byName[base] = append(byName[base], peer.DNSName)
+	}
+
+	conflicts := []shortNameConflict{}
+	for name, peers := range byName {
+		if len(peers) > 1 {
+			sort.Strings(peers)
+			conflicts = append(conflicts, shortNameConflict{Name: name, Peers: peers})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Name < conflicts[j].Name })
+	return conflicts
+}
+
+// handleAPIConflicts lists the base names shared by several peers, which
+// resolve according to -short-name-conflicts.
+func (s *DNSServer) handleAPIConflicts(w http.ResponseWriter, r *http.Request) {
+	status := s.status.Load()
+	if status == nil {
+		http.Error(w, "not connected to tailnet yet", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, s.shortNameConflicts(status))
+}
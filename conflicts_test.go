@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestShortNameConflictsWithSelf(t *testing.T) {
+	self := &ipnstate.PeerStatus{
+		DNSName:      "proxy.tail1.ts.net.",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+	}
+	status := newTestStatus(self,
+		&ipnstate.PeerStatus{
+			DNSName:      "proxy.tail2.ts.net.",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.2")},
+		},
+		&ipnstate.PeerStatus{
+			DNSName:      "web.tail1.ts.net.",
+			TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.3")},
+		},
+	)
+	s := &DNSServer{domains: []string{"tail1.ts.net"}, shortNames: conflictPick}
+
+	want := []shortNameConflict{{Name: "proxy", Peers: []string{"proxy.tail1.ts.net.", "proxy.tail2.ts.net."}}}
+	if got := s.shortNameConflicts(status); !reflect.DeepEqual(got, want) {
+		t.Errorf("shortNameConflicts() = %v, want %v", got, want)
+	}
+	if got := s.ambiguousPeers(status, "proxy"); len(got) != 2 {
+		t.Errorf("ambiguousPeers(proxy) = %v, want the proxy and its namesake", got)
+	}
+}
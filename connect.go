@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tsnet"
+)
+
+// connectTimeout bounds each attempt to bring the tailnet connection up with
+// -require-connected.
+const connectTimeout = 60 * time.Second
+
+// retryConnect reports whether to try connecting to the tailnet again after
+// the attempt numbered attempt (from 0) failed with err, waiting
+// -connect-retry-interval first. It returns false once -connect-retries are
+// used up, or early if ctx is done.
+func retryConnect(ctx context.Context, attempt int, err error) bool {
+	if *connectRetries >= 0 && attempt >= *connectRetries {
+		return false
+	}
+	interval := time.Duration(*connectInterval) * time.Second
+	log.Printf("Error connecting to tailnet (attempt %d): %v; retrying in %v", attempt+1, err, interval)
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(interval):
+		return true
+	}
+}
+
+// connectTailnet waits for s to come up, retrying per -connect-retries.
+// onRetry is called before every retry.
+func connectTailnet(ctx context.Context, s *tsnet.Server, onRetry func()) (*ipnstate.Status, error) {
+	for attempt := 0; ; attempt++ {
+		status, err := upOnce(ctx, s)
+		if err == nil {
+			return status, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !retryConnect(ctx, attempt, err) {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		onRetry()
+	}
+}
+
+// upOnce makes one attempt to bring s up, giving up after connectTimeout
+// with -require-connected.
+func upOnce(ctx context.Context, s *tsnet.Server) (*ipnstate.Status, error) {
+	if *requireConnected {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connectTimeout)
+		defer cancel()
+	}
+	return s.Up(ctx)
+}
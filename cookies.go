@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// cookieSecretFile holds the server cookie secret in -state-dir, so
+	// cookies stay valid across restarts.
+	cookieSecretFile = "dns-cookie-secret"
+
+	cookieSecretSize = 16 // bytes
+	clientCookieSize = 8  // bytes, fixed by RFC 7873
+	serverCookieSize = 16 // bytes, of the allowed 8 to 32
+)
+
+// cookieJar computes the server cookies of DNS Cookies (RFC 7873), which
+// let clients prove they received earlier responses and so are not
+// spoofing their address.
+type cookieJar struct {
+	secret []byte
+}
+
+// loadCookieJar reads the cookie secret from dir, creating it on first
+// use. With dir empty, a new secret is used for this run only.
+func loadCookieJar(dir string) (*cookieJar, error) {
+	if dir == "" {
+		secret := make([]byte, cookieSecretSize)
+		rand.Read(secret)
+		return &cookieJar{secret: secret}, nil
+	}
+
+	path := filepath.Join(dir, cookieSecretFile)
+	secret, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		secret = make([]byte, cookieSecretSize)
+		rand.Read(secret)
+		err = os.WriteFile(path, secret, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) != cookieSecretSize {
+		return nil, fmt.Errorf("%s holds %d bytes, want %d", path, len(secret), cookieSecretSize)
+	}
+	return &cookieJar{secret: secret}, nil
+}
+
+// serverCookie returns the server cookie for a client cookie sent from
+// addr: a truncated HMAC-SHA256 of both under the secret.
+func (j *cookieJar) serverCookie(client []byte, addr net.Addr) []byte {
+	mac := hmac.New(sha256.New, j.secret)
+	mac.Write(client)
+	mac.Write(extractClientIP(addr).AsSlice())
+	return mac.Sum(nil)[:serverCookieSize]
+}
+
+// check parses the COOKIE option of r, if any. It returns the option to
+// answer with, whether r carried a valid server cookie from an earlier
+// response, and an error if the option is malformed.
+func (j *cookieJar) check(r *dns.Msg, addr net.Addr) (reply *dns.EDNS0_COOKIE, valid bool, err error) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, false, nil
+	}
+	for _, o := range opt.Option {
+		cookie, ok := o.(*dns.EDNS0_COOKIE)
+		if !ok {
+			continue
+		}
+		b, err := hex.DecodeString(cookie.Cookie)
+		// RFC 7873 section 5.2.2: a client cookie alone, or followed by
+		// a server cookie of 8 to 32 bytes
+		if err != nil || (len(b) != clientCookieSize && (len(b) < clientCookieSize+8 || len(b) > clientCookieSize+32)) {
+			return nil, false, fmt.Errorf("malformed cookie of %d bytes", len(b))
+		}
+		server := j.serverCookie(b[:clientCookieSize], addr)
+		valid = hmac.Equal(b[clientCookieSize:], server)
+		reply = &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(append(b[:clientCookieSize:clientCookieSize], server...)),
+		}
+		return reply, valid, nil
+	}
+	return nil, false, nil
+}
+
+// cookieWriter puts the COOKIE option for the query in every response,
+// replacing any an upstream sent for a forwarded query.
+type cookieWriter struct {
+	dns.ResponseWriter
+	cookie *dns.EDNS0_COOKIE
+}
+
+func (w cookieWriter) WriteMsg(m *dns.Msg) error {
+	if opt := m.IsEdns0(); opt != nil {
+		var options []dns.EDNS0
+		for _, o := range opt.Option {
+			if o.Option() != dns.EDNS0COOKIE {
+				options = append(options, o)
+			}
+		}
+		opt.Option = options
+	}
+	addEDNSOption(m, w.cookie)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// handleCookies applies DNS Cookies to r, wrapping w so responses carry
+// the server cookie. Malformed cookies are answered FORMERR, in which case
+// handled is true. valid reports whether the client returned a server
+// cookie it was given before.
+func (s *DNSServer) handleCookies(w dns.ResponseWriter, r *dns.Msg) (_ dns.ResponseWriter, valid, handled bool) {
+	if s.cookies == nil {
+		return w, false, false
+	}
+	reply, valid, err := s.cookies.check(r, w.RemoteAddr())
+	if err != nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		m.SetEdns0(ednsUDPSize, false)
+		w.WriteMsg(m)
+		return w, false, true
+	}
+	if reply != nil {
+		w = cookieWriter{ResponseWriter: w, cookie: reply}
+	}
+	return w, valid, false
+}
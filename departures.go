@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// departureTracker remembers peers that recently left the tailnet, such as
+// ephemeral nodes that disconnected, so queries for them can be answered
+// NXDOMAIN during the -departed-grace window.
+type departureTracker struct {
+	grace time.Duration
+
+	mu         sync.Mutex
+	present    map[string]bool      // peer DNS names in the last status
+	departedAt map[string]time.Time // peer DNS names no longer present
+}
+
+func newDepartureTracker(grace time.Duration) *departureTracker {
+	return &departureTracker{
+		grace:      grace,
+		present:    make(map[string]bool),
+		departedAt: make(map[string]time.Time),
+	}
+}
+
+// run updates the tracker on every status update until the process exits.
+func (d *departureTracker) run(s *DNSServer) {
+	for range s.updates.subscribe() {
+		d.observe(s.status.Load())
+	}
+}
+
+// observe records departures of peers missing from status, and forgets
+// peers that have come back or whose grace period has passed.
+func (d *departureTracker) observe(status *ipnstate.Status) {
+	now := time.Now()
+	present := make(map[string]bool, len(status.Peer))
+	for _, peer := range status.Peer {
+		if peer.DNSName != "" {
+			present[strings.ToLower(dnsname.TrimSuffix(peer.DNSName, "."))] = true
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name := range d.present {
+		if !present[name] {
+			log.Printf("Peer %s departed the tailnet", name)
+			d.departedAt[name] = now
+		}
+	}
+	for name, at := range d.departedAt {
+		if present[name] || now.Sub(at) > d.grace {
+			delete(d.departedAt, name)
+		}
+	}
+	d.present = present
+}
+
+// departed reports whether qname names a peer that left the tailnet within
+// the grace period, matching full names and, with domains configured, base
+// names.
+func (d *departureTracker) departed(s *DNSServer, qname string) bool {
+	qname = strings.ToLower(qname)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, at := range d.departedAt {
+		if time.Since(at) > d.grace {
+			continue
+		}
+		if qname == name || (len(s.domains) > 0 && s.trimDomain(qname) == dnsname.FirstLabel(name)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dnameFlags collects the -dname flags.
+var dnameFlags = dnameRecords{}
+
+// dnameRecords maps a lowercase FQDN zone to the FQDN its subtree is
+// redirected to (RFC 6672). It implements flag.Value for -dname.
+type dnameRecords map[string]string
+
+func (d dnameRecords) String() string {
+	var records []string
+	for from, to := range d {
+		records = append(records, from+"="+to)
+	}
+	sort.Strings(records)
+	return strings.Join(records, " ")
+}
+
+// Set parses a record of the form from-zone=to-zone.
+func (d dnameRecords) Set(v string) error {
+	from, to, ok := strings.Cut(v, "=")
+	from = strings.ToLower(strings.TrimSpace(from))
+	to = strings.TrimSpace(to)
+	if !ok || from == "" || to == "" {
+		return fmt.Errorf("%q is not of the form from-zone=to-zone", v)
+	}
+	for _, name := range []string{from, to} {
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("%q is not a valid domain name", name)
+		}
+	}
+	d[dns.Fqdn(from)] = dns.Fqdn(to)
+	return nil
+}
+
+// match returns the most specific DNAME owner at or above name.
+func (d dnameRecords) match(name string) (owner, target string, ok bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	for from, to := range d {
+		if dns.IsSubDomain(from, name) && len(from) > len(owner) {
+			owner, target, ok = from, to, true
+		}
+	}
+	return owner, target, ok
+}
+
+// handleDNAME answers q if it falls under a -dname zone: with the DNAME
+// record itself for the zone apex, and otherwise with the DNAME, a CNAME
+// synthesized into the target zone and, for address queries, the target's
+// records. It reports whether q was handled.
+func (s *DNSServer) handleDNAME(q dns.Question, m *dns.Msg, qlog *slog.Logger) bool {
+	owner, target, ok := s.dnames.match(q.Name)
+	if !ok {
+		return false
+	}
+
+	dname := &dns.DNAME{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeDNAME,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(*ttl),
+		},
+		Target: target,
+	}
+	if strings.EqualFold(dns.Fqdn(q.Name), owner) {
+		// The apex itself is not redirected
+		if q.Qtype == dns.TypeDNAME || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, dname)
+		}
+		return true
+	}
+
+	// Replace the owner suffix, keeping the query's own labels as sent
+	prefix := dns.Fqdn(q.Name)[:len(dns.Fqdn(q.Name))-len(owner)]
+	newName := prefix + target
+	if _, ok := dns.IsDomainName(newName); !ok {
+		// RFC 6672 section 2.2: the substituted name is too long
+		m.Rcode = dns.RcodeYXDomain
+		m.Answer = append(m.Answer, dname)
+		return true
+	}
+
+	qlog.Info("DNAME redirect", "owner", owner, "target", target, "name", q.Name, "new_name", newName)
+	m.Answer = append(m.Answer, dname, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(*ttl),
+		},
+		Target: newName,
+	})
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA {
+		s.handleAddressQuery(dns.Question{Name: newName, Qtype: q.Qtype, Qclass: q.Qclass}, m, qlog)
+	}
+	return true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+// ednsUDPSize is the UDP payload size advertised in the OPT records the
+// proxy adds to responses.
+const ednsUDPSize = 1232
+
+// addExtendedError attaches an Extended DNS Error (RFC 8914) with code and
+// text to m, explaining an error or policy response. It is only sent to
+// clients that used EDNS0; see ednsWriter.
+func addExtendedError(m *dns.Msg, code uint16, text string) {
+	addEDNSOption(m, &dns.EDNS0_EDE{InfoCode: code, ExtraText: text})
+}
+
+// addEDNSOption adds o to m's OPT record, adding the record if needed.
+func addEDNSOption(m *dns.Msg, o dns.EDNS0) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(ednsUDPSize, false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, o)
+}
+
+// ednsWriter strips OPT records from responses to queries without one, as
+// clients that did not use EDNS0 may not understand them (RFC 6891 section
+// 7).
+type ednsWriter struct {
+	dns.ResponseWriter
+}
+
+func (w ednsWriter) WriteMsg(m *dns.Msg) error {
+	if m.IsEdns0() != nil {
+		m.Extra = slices.DeleteFunc(slices.Clone(m.Extra), func(rr dns.RR) bool {
+			return rr.Header().Rrtype == dns.TypeOPT
+		})
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
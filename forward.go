@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Policies for queries outside the tailnet zones, set by -out-of-zone.
+const (
+	policyRefused  = "refused"
+	policyNXDomain = "nxdomain"
+	policyServFail = "servfail"
+	policyForward  = "forward"
+)
+
+// outOfZonePolicy resolves the -out-of-zone flag, defaulting to forwarding
+// when upstreams are configured and refusing otherwise.
+func outOfZonePolicy(policy, upstreams string) string {
+	if policy != "" {
+		return strings.ToLower(policy)
+	}
+	if upstreams != "" {
+		return policyForward
+	}
+	return policyRefused
+}
+
+// upstreamList parses the -upstream flag, adding port 53 to entries
+// without one.
+func upstreamList(s string) []string {
+	var out []string
+	for _, addr := range splitList(s) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "53")
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// knownTLSNames are the certificate names of public resolvers commonly
+// used as DNS-over-TLS upstreams by IP address.
+var knownTLSNames = map[string]string{
+	"1.1.1.1":              "cloudflare-dns.com",
+	"1.0.0.1":              "cloudflare-dns.com",
+	"2606:4700:4700::1111": "cloudflare-dns.com",
+	"2606:4700:4700::1001": "cloudflare-dns.com",
+	"8.8.8.8":              "dns.google",
+	"8.8.4.4":              "dns.google",
+	"2001:4860:4860::8888": "dns.google",
+	"2001:4860:4860::8844": "dns.google",
+	"9.9.9.9":              "dns.quad9.net",
+	"149.112.112.112":      "dns.quad9.net",
+}
+
+// parseUpstreams parses the -upstream flag like upstreamList, and also
+// returns the TLS server name for each upstream to be reached over DNS over
+// TLS (RFC 7858): those given as tls://host[:port][#name], or all of them
+// if allTLS is set. TLS upstreams default to port 853, and their server
+// name to the one after #, the known name of a public resolver, or the
+// host itself. DNS-over-HTTPS upstreams are kept as https:// URLs.
+func parseUpstreams(s string, allTLS bool) (addrs []string, tlsNames map[string]string) {
+	tlsNames = make(map[string]string)
+	for _, entry := range splitList(s) {
+		if isDoHUpstream(entry) {
+			addrs = append(addrs, entry)
+			continue
+		}
+		entry, isTLS := strings.CutPrefix(entry, "tls://")
+		isTLS = isTLS || allTLS
+		if !isTLS {
+			addrs = append(addrs, upstreamList(entry)...)
+			continue
+		}
+
+		hostport, name, _ := strings.Cut(entry, "#")
+		host, port, err := net.SplitHostPort(hostport)
+		if err != nil {
+			host, port = strings.Trim(hostport, "[]"), "853"
+		}
+		if name == "" {
+			name = knownTLSNames[host]
+		}
+		if name == "" {
+			name = host
+		}
+		addr := net.JoinHostPort(host, port)
+		addrs = append(addrs, addr)
+		tlsNames[addr] = name
+	}
+	return addrs, tlsNames
+}
+
+// handleOutOfZone answers a query the server is not authoritative for
+// according to the -out-of-zone policy.
+func (s *DNSServer) handleOutOfZone(w dns.ResponseWriter, r, m *dns.Msg) {
+	m.Authoritative = false
+
+	// Recursion is only available for names that get forwarded. Query
+	// types with their own upstreams are forwarded whatever the policy.
+	_, byType := s.typeUpstreams[r.Question[0].Qtype]
+	policy := s.outOfZone
+	if byType {
+		policy = policyForward
+	}
+	m.RecursionAvailable = policy == policyForward
+
+	switch policy {
+	case policyForward:
+		resp, err := s.forward(r, upstreamNetwork(w.RemoteAddr()))
+		if err == nil {
+			resp.RecursionAvailable = true
+			if s.minimal {
+				// Upstreams may add glue and referrals for other zones
+				minimizeResponse(resp)
+			}
+			if s.applyResponsePolicy(resp) {
+				w.WriteMsg(resp)
+			}
+			return
+		}
+		log.Printf("Error forwarding %s: %v", r.Question[0].Name, err)
+		m.Rcode = dns.RcodeServerFailure
+		addExtendedError(m, dns.ExtendedErrorCodeNoReachableAuthority, "no upstream answered")
+	case policyNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case policyServFail:
+		m.Rcode = dns.RcodeServerFailure
+	default:
+		m.Rcode = dns.RcodeRefused
+		addExtendedError(m, dns.ExtendedErrorCodeNotAuthoritative, "name is outside the tailnet zones")
+	}
+
+	log.Printf("Out-of-zone query %s: %s", r.Question[0].Name, dns.RcodeToString[m.Rcode])
+	w.WriteMsg(m)
+}
+
+// upstreamNetwork returns the transport to forward a query from the client
+// at addr over: UDP for datagram clients, including those on the
+// -unix-socket datagram socket, and TCP for stream clients.
+func upstreamNetwork(addr net.Addr) string {
+	switch addr.Network() {
+	case "udp", "udp4", "udp6", "unixgram":
+		return "udp"
+	}
+	return "tcp"
+}
+
+// forward sends r to each upstream in turn over network ("udp" or "tcp")
+// and returns the first response received.
+func (s *DNSServer) forward(r *dns.Msg, network string) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if s.stripECS {
+		r = zeroClientSubnet(r)
+	}
+	// Per-type upstreams are forwarded to, even with -qname-minimize
+	upstreams, byType := s.typeUpstreams[r.Question[0].Qtype]
+	if !byType {
+		if s.qnameMinimize {
+			return s.resolveMinimized(ctx, r, network)
+		}
+		upstreams = s.upstreams
+	}
+
+	err := errors.New("no upstream configured")
+	for _, addr := range upstreams {
+		var resp *dns.Msg
+		resp, err = s.exchangeUpstream(ctx, r, addr, network)
+		if err == nil {
+			if s.debug {
+				log.Printf("Forwarded %s to %s: %s", r.Question[0].Name, addr, dns.RcodeToString[resp.Rcode])
+			}
+			return resp, nil
+		}
+		log.Printf("Upstream %s failed: %v", addr, err)
+	}
+	return nil, err
+}
+
+// exchangeUpstream sends r to the upstream addr, over network for plain
+// DNS upstreams and over TLS or HTTPS for the others.
+func (s *DNSServer) exchangeUpstream(ctx context.Context, r *dns.Msg, addr, network string) (*dns.Msg, error) {
+	if isDoHUpstream(addr) {
+		return s.exchangeDoH(ctx, r, addr)
+	}
+	client := &dns.Client{Net: network}
+	if name, ok := s.tlsUpstreams[addr]; ok {
+		client = &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{
+			ServerName:         name,
+			InsecureSkipVerify: *upstreamInsecure,
+		}}
+	}
+	resp, _, err := client.ExchangeContext(ctx, r, addr)
+	return resp, err
+}
+
+// zeroClientSubnet returns r with any EDNS Client Subnet option replaced by
+// one with a zero source prefix length and address, which tells upstreams
+// not to use the client's address (RFC 7871 section 7.1.2). r itself is
+// left unmodified.
+func zeroClientSubnet(r *dns.Msg) *dns.Msg {
+	opt := r.IsEdns0()
+	if opt == nil || !slices.ContainsFunc(opt.Option, isClientSubnet) {
+		return r
+	}
+
+	r = r.Copy()
+	opt = r.IsEdns0()
+	for i, o := range opt.Option {
+		ecs, ok := o.(*dns.EDNS0_SUBNET)
+		if !ok {
+			continue
+		}
+		zeroed := &dns.EDNS0_SUBNET{
+			Code:   dns.EDNS0SUBNET,
+			Family: ecs.Family,
+		}
+		if ecs.Family == 2 {
+			zeroed.Address = net.IPv6zero
+		} else {
+			zeroed.Address = net.IPv4zero
+		}
+		opt.Option[i] = zeroed
+	}
+	return r
+}
+
+func isClientSubnet(o dns.EDNS0) bool {
+	return o.Option() == dns.EDNS0SUBNET
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io"
+	"log"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func FuzzExtractIPFromReverseDNS(f *testing.F) {
+	f.Add("2.0.64.100.in-addr.arpa.")
+	f.Add("1.0.0.10.IN-ADDR.ARPA")
+	f.Add("2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.")
+	f.Add("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.")
+	f.Add("256.0.64.100.in-addr.arpa.")
+	f.Add("ab.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.")
+	f.Fuzz(func(t *testing.T, name string) {
+		ip := extractIPFromReverseDNS(name)
+		if ip.IsValid() && ip.Zone() != "" {
+			t.Errorf("extractIPFromReverseDNS(%q) = %v, has a zone", name, ip)
+		}
+	})
+}
+
+func FuzzHandleDNSRequest(f *testing.F) {
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+	}{
+		{"web.tail1.ts.net.", dns.TypeA},
+		{"web.tail1.ts.net.", dns.TypeAAAA},
+		{"2.0.64.100.in-addr.arpa.", dns.TypePTR},
+		{"tail1.ts.net.", dns.TypeSOA},
+		{"tail1.ts.net.", dns.TypeAXFR},
+		{"web.tail1.ts.net.", dns.TypeANY},
+		{"version.bind.", dns.TypeTXT},
+		{strings.Repeat("a.", 127), dns.TypeA},
+		{strings.Repeat("a", 63) + ".tail1.ts.net.", dns.TypeA},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(q.name, q.qtype)
+		m.SetEdns0(dns.DefaultMsgSize, true)
+		b, err := m.Pack()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	// Every query is logged, which would swamp the fuzzer's output
+	log.SetOutput(io.Discard)
+	s := newStaticTestServer(f)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		r := new(dns.Msg)
+		if err := r.Unpack(b); err != nil {
+			return
+		}
+		s.handleDNSRequest(&captureWriter{}, r)
+	})
+}
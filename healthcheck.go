@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// healthCheckFlags and funnelRecordFlags collect the -health-check and
+// -funnel-record flags.
+var (
+	healthCheckFlags  = peerURLs{}
+	funnelRecordFlags = peerURLs{}
+)
+
+// peerURLs maps a lowercase peer name, full or base, to a URL. It
+// implements flag.Value for repeatable peer=url flags such as -health-check.
+type peerURLs map[string]string
+
+func (p peerURLs) String() string {
+	var entries []string
+	for peer, u := range p {
+		entries = append(entries, peer+"="+u)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
+
+// Set parses one entry in the form peer=url.
+func (p peerURLs) Set(v string) error {
+	peer, rawURL, ok := strings.Cut(v, "=")
+	if !ok || peer == "" {
+		return fmt.Errorf("%q must be peer=url", v)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("URL %q must be an http or https URL", rawURL)
+	}
+	p[strings.ToLower(strings.TrimSuffix(peer, "."))] = rawURL
+	return nil
+}
+
+// lookup returns the URL for the peer with full DNS name name, matching
+// entries by full or base name.
+func (p peerURLs) lookup(name string) (key, u string, ok bool) {
+	name = strings.ToLower(dnsname.TrimSuffix(name, "."))
+	for _, key := range []string{name, dnsname.FirstLabel(name)} {
+		if u, ok := p[key]; ok {
+			return key, u, true
+		}
+	}
+	return "", "", false
+}
+
+// healthChecker polls each -health-check URL and counts consecutive
+// failures, so peers whose service is down can be left out of answers.
+type healthChecker struct {
+	checks    peerURLs
+	interval  time.Duration
+	timeout   time.Duration
+	threshold int
+
+	mu       sync.Mutex
+	failures map[string]int // consecutive failures by check peer name
+}
+
+func newHealthChecker(checks peerURLs, interval, timeout time.Duration, threshold int) *healthChecker {
+	return &healthChecker{
+		checks:    checks,
+		interval:  interval,
+		timeout:   timeout,
+		threshold: threshold,
+		failures:  make(map[string]int),
+	}
+}
+
+// healthy reports whether peer has not reached the failure threshold of its
+// health check. Peers without a health check are always healthy.
+func (h *healthChecker) healthy(peer *ipnstate.PeerStatus) bool {
+	key, _, ok := h.checks.lookup(peer.DNSName)
+	if !ok {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures[key] < h.threshold
+}
+
+// run checks every URL concurrently once per interval. The HTTP client
+// dials over the tailnet, so tailnet-only services can be checked.
+func (h *healthChecker) run(s *DNSServer) {
+	client := s.tsnet.HTTPClient()
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for peer, u := range h.checks {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h.check(client, peer, u)
+			}()
+		}
+		wg.Wait()
+		<-ticker.C
+	}
+}
+
+func (h *healthChecker) check(client *http.Client, peer, u string) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	err := httpCheck(ctx, client, u)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		if h.failures[peer] >= h.threshold {
+			log.Printf("Health check for %s recovered, returning it in answers again", peer)
+		}
+		h.failures[peer] = 0
+		return
+	}
+	metricHealthCheckFailures.Add(peer, 1)
+	h.failures[peer]++
+	if h.failures[peer] == h.threshold {
+		log.Printf("Health check for %s failed %d times, suppressing it: %v", peer, h.threshold, err)
+	}
+}
+
+// httpCheck fetches u and fails unless it answers with a 2xx or 3xx status.
+func httpCheck(ctx context.Context, client *http.Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/tsnet"
+	"tailscale.com/util/dnsname"
+)
+
+// TestIntegration_PeerResolution joins a real tailnet with the auth key in
+// TS_TEST_AUTHKEY, preferably an ephemeral one, and resolves this node's
+// own name through the proxy. Run it with "go test -tags integration".
+func TestIntegration_PeerResolution(t *testing.T) {
+	authKey := os.Getenv("TS_TEST_AUTHKEY")
+	if authKey == "" {
+		t.Skip("TS_TEST_AUTHKEY not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	ts := &tsnet.Server{
+		Hostname:  "tsmagicproxy-test",
+		AuthKey:   authKey,
+		Dir:       t.TempDir(),
+		Ephemeral: true,
+		Logf:      t.Logf,
+	}
+	defer ts.Close()
+	status, err := ts.Up(ctx)
+	if err != nil {
+		t.Fatalf("connecting to tailnet: %v", err)
+	}
+	selfName := status.Self.DNSName
+	domain := strings.TrimPrefix(selfName, dnsname.FirstLabel(selfName)+".")
+
+	s := &DNSServer{
+		tsnet:      ts,
+		outOfZone:  policyRefused,
+		ipType:     "both",
+		ipSelect:   "all",
+		shortNames: "pick",
+	}
+	s.SetStatus(status, []string{strings.TrimSuffix(domain, ".")})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(s.handleDNSRequest)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(selfName), dns.TypeA)
+	resp, _, err := new(dns.Client).ExchangeContext(ctx, r, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("querying %s: %v", selfName, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[resp.Rcode])
+	}
+
+	var want string
+	for _, ip := range status.TailscaleIPs {
+		if ip.Is4() {
+			want = ip.String()
+		}
+	}
+	var got []string
+	for _, rr := range resp.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			got = append(got, a.A.String())
+			if a.A.String() == want {
+				return
+			}
+		}
+	}
+	t.Fatalf("A records = %v, want %s", got, want)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/miekg/dns"
+)
+
+// Address selections for peers with several addresses of the queried type,
+// set by -ip-select.
+const (
+	ipSelectAll    = "all"
+	ipSelectFirst  = "first"
+	ipSelectLast   = "last"
+	ipSelectRandom = "random"
+)
+
+func validIPSelect(mode string) bool {
+	switch mode {
+	case ipSelectAll, ipSelectFirst, ipSelectLast, ipSelectRandom:
+		return true
+	}
+	return false
+}
+
+// selectAddresses returns the single record of rrs, one peer's address
+// records of the queried type, that mode selects, or all of them.
+func selectAddresses(rrs []dns.RR, mode string) []dns.RR {
+	if len(rrs) <= 1 {
+		return rrs
+	}
+	switch mode {
+	case ipSelectFirst:
+		return rrs[:1]
+	case ipSelectLast:
+		return rrs[len(rrs)-1:]
+	case ipSelectRandom:
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(rrs))))
+		if err != nil {
+			return rrs[:1]
+		}
+		i := n.Int64()
+		return rrs[i : i+1]
+	}
+	return rrs
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// Address types answered for peers, set by -ip-type and -ip-type-override.
+const (
+	ipTypeIPv4 = "ipv4"
+	ipTypeIPv6 = "ipv6"
+	ipTypeBoth = "both"
+)
+
+// ipTypeOverrideFlags collects the -ip-type-override flags.
+var ipTypeOverrideFlags = ipTypeOverrides{}
+
+// ipTypeOverrides maps a lowercase peer name, full or base, to the address
+// type answered for it. It implements flag.Value for -ip-type-override.
+type ipTypeOverrides map[string]string
+
+func (o ipTypeOverrides) String() string {
+	var entries []string
+	for peer, t := range o {
+		entries = append(entries, peer+"="+t)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, " ")
+}
+
+// Set parses an override of the form peer=ipv4|ipv6|both.
+func (o ipTypeOverrides) Set(v string) error {
+	peer, t, ok := strings.Cut(v, "=")
+	t = strings.ToLower(t)
+	if !ok || peer == "" {
+		return fmt.Errorf("%q must be peer=ipv4, peer=ipv6 or peer=both", v)
+	}
+	if !validIPType(t) {
+		return fmt.Errorf("address type %q must be ipv4, ipv6 or both", t)
+	}
+	o[strings.ToLower(strings.TrimSuffix(peer, "."))] = t
+	return nil
+}
+
+// lookup returns the override for the peer with full DNS name name,
+// matching entries by full or base name.
+func (o ipTypeOverrides) lookup(name string) (string, bool) {
+	name = strings.ToLower(dnsname.TrimSuffix(name, "."))
+	for _, key := range []string{name, dnsname.FirstLabel(name)} {
+		if t, ok := o[key]; ok {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+func validIPType(t string) bool {
+	return t == ipTypeIPv4 || t == ipTypeIPv6 || t == ipTypeBoth
+}
+
+// ipTypeAllows reports whether records of qtype may be answered under the
+// address type t.
+func ipTypeAllows(t string, qtype uint16) bool {
+	switch t {
+	case ipTypeIPv4:
+		return qtype == dns.TypeA
+	case ipTypeIPv6:
+		return qtype == dns.TypeAAAA
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// zoneSnapshot is the zone's records at one SOA serial.
+type zoneSnapshot struct {
+	serial  uint32
+	records []dns.RR
+}
+
+// zoneHistory keeps the most recent zone versions, oldest first, so IXFR
+// can send the differences from a secondary's serial.
+type zoneHistory struct {
+	size      int
+	snapshots []zoneSnapshot
+}
+
+// add records the zone at serial, dropping the oldest version beyond size.
+func (h *zoneHistory) add(serial uint32, records []dns.RR) {
+	if h.size <= 0 {
+		return
+	}
+	h.snapshots = append(h.snapshots, zoneSnapshot{serial, records})
+	if len(h.snapshots) > h.size {
+		h.snapshots = h.snapshots[len(h.snapshots)-h.size:]
+	}
+}
+
+// get returns the records at serial, if that version is still kept.
+func (h *zoneHistory) get(serial uint32) ([]dns.RR, bool) {
+	for _, snap := range h.snapshots {
+		if snap.serial == serial {
+			return snap.records, true
+		}
+	}
+	return nil, false
+}
+
+// handleIXFR answers an incremental zone transfer request (RFC 1995) with
+// the records deleted and added since the serial in the request's authority
+// section. Secondaries already at the current serial get the SOA alone, and
+// unknown serials fall back to a full AXFR-style transfer.
+func (s *DNSServer) handleIXFR(w dns.ResponseWriter, r *dns.Msg) {
+	if !s.transferAllowed(w, r, false) {
+		return
+	}
+
+	status, err := s.fetchStatus()
+	if err != nil {
+		log.Printf("Error getting status: %v", err)
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	records := zoneRecords(status, s.domain, *ttl)
+	soa := s.soaRecord(status, records)
+
+	var clientSOA *dns.SOA
+	if len(r.Ns) > 0 {
+		clientSOA, _ = r.Ns[0].(*dns.SOA)
+	}
+	if clientSOA == nil {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeFormatError)
+		w.WriteMsg(m)
+		return
+	}
+
+	// Up to date, or over UDP where the differences may not fit: reply
+	// with the current SOA, which tells the secondary to retry over TCP
+	// if it is behind
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	if clientSOA.Serial == soa.Serial || !isTCP {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.Answer = []dns.RR{soa}
+		w.WriteMsg(m)
+		return
+	}
+
+	old, ok := s.serial.snapshot(clientSOA.Serial)
+	if !ok {
+		log.Printf("IXFR from serial %d not in history, sending full zone", clientSOA.Serial)
+		s.sendAXFR(w, r, soa, records)
+		return
+	}
+
+	deleted, added := diffRecords(old, records)
+	log.Printf("IXFR of %s to %s: serial %d to %d, %d deleted, %d added",
+		r.Question[0].Name, w.RemoteAddr(), clientSOA.Serial, soa.Serial, len(deleted), len(added))
+
+	oldSOA := *soa
+	oldSOA.Serial = clientSOA.Serial
+	rrs := make([]dns.RR, 0, len(deleted)+len(added)+4)
+	rrs = append(rrs, soa, &oldSOA)
+	rrs = append(rrs, deleted...)
+	rrs = append(rrs, soa)
+	rrs = append(rrs, added...)
+	rrs = append(rrs, soa)
+	if streamTransfer(w, r, rrs) {
+		metricIXFRTransfers.Add(1)
+	}
+}
+
+// diffRecords returns the records in old but not in cur, and those in cur
+// but not in old.
+func diffRecords(old, cur []dns.RR) (deleted, added []dns.RR) {
+	inOld := make(map[string]bool, len(old))
+	for _, rr := range old {
+		inOld[rr.String()] = true
+	}
+	inCur := make(map[string]bool, len(cur))
+	for _, rr := range cur {
+		inCur[rr.String()] = true
+		if !inOld[rr.String()] {
+			added = append(added, rr)
+		}
+	}
+	for _, rr := range old {
+		if !inCur[rr.String()] {
+			deleted = append(deleted, rr)
+		}
+	}
+	return deleted, added
+}
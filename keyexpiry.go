@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+const (
+	// keyExpiryCheckInterval is how often the node key's expiry is checked
+	// between status updates.
+	keyExpiryCheckInterval = time.Minute
+
+	// keyRefreshMaxBackoff caps the wait between attempts to log in again
+	// while the node key stays expired.
+	keyRefreshMaxBackoff = 30 * time.Minute
+)
+
+// watchKeyExpiry checks whether this node's key has expired, which cuts
+// the proxy off from the tailnet. With refreshURL set, it fetches a new
+// auth key from it and logs in again; otherwise, or if that fails, it logs
+// an alert every alertInterval until the node is re-authenticated.
+func (s *DNSServer) watchKeyExpiry(refreshURL string, alertInterval time.Duration) {
+	updates := s.updates.subscribe()
+	var lastAlert, nextAttempt time.Time
+	// expired is the expiry the attempts so far were made for. A login
+	// only shows in the status once tailscaled has the new key, so until
+	// the expiry changes further attempts back off rather than fetching
+	// a new key every check.
+	var expired time.Time
+	loggedIn := false
+	backoff := keyExpiryCheckInterval
+	for {
+		select {
+		case <-updates:
+		case <-time.After(keyExpiryCheckInterval):
+		}
+		status := s.status.Load()
+		if status == nil || status.Self == nil || status.Self.KeyExpiry == nil {
+			continue
+		}
+		expiry := *status.Self.KeyExpiry
+		if expiry.After(time.Now()) {
+			continue
+		}
+		if !expiry.Equal(expired) {
+			expired = expiry
+			loggedIn = false
+			nextAttempt = time.Time{}
+			backoff = keyExpiryCheckInterval
+		}
+
+		if refreshURL != "" && !time.Now().Before(nextAttempt) {
+			nextAttempt = time.Now().Add(backoff)
+			backoff = min(2*backoff, keyRefreshMaxBackoff)
+			err := s.reauthenticate(refreshURL)
+			loggedIn = err == nil
+			if loggedIn {
+				log.Printf("Node key expired at %v; logged in again with an auth key from -authkey-refresh-url", expiry)
+				continue
+			}
+			log.Printf("Error re-authenticating after node key expiry: %v", err)
+		}
+		// A login is given until the next attempt to show the new key
+		if !loggedIn && time.Since(lastAlert) >= alertInterval {
+			lastAlert = time.Now()
+			log.Printf("ALERT: node key expired at %v; DNS answers are stale until this node is re-authenticated (set -authkey-refresh-url, or restart with a new -authkey)", expiry)
+		}
+	}
+}
+
+// reauthenticate fetches a new auth key from refreshURL and restarts the
+// node's login with it.
+func (s *DNSServer) reauthenticate(refreshURL string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	key, err := fetchAuthKey(ctx, refreshURL)
+	if err != nil {
+		return fmt.Errorf("fetching auth key: %w", err)
+	}
+	lc, err := s.tsnet.LocalClient()
+	if err != nil {
+		return fmt.Errorf("getting local client: %w", err)
+	}
+	if err := lc.Start(ctx, ipn.Options{AuthKey: key}); err != nil {
+		return fmt.Errorf("starting login: %w", err)
+	}
+	return lc.StartLoginInteractive(ctx)
+}
+
+// fetchAuthKey returns the auth key served by GET on u. The key is never
+// logged.
+func fetchAuthKey(ctx context.Context, u string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(body))
+	if key == "" {
+		return "", errors.New("empty response")
+	}
+	return key, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"time"
+)
+
+// latencyInjector delays responses for -test-latency, to test how clients
+// cope with a slow resolver.
+type latencyInjector struct {
+	delay  time.Duration
+	jitter time.Duration
+	rate   float64 // fraction of queries delayed
+}
+
+// wait sleeps for the configured delay, plus or minus up to the jitter,
+// for the sampled fraction of queries.
+func (l *latencyInjector) wait() {
+	if l.rate < 1 {
+		var b [8]byte
+		rand.Read(b[:])
+		// 53 random bits give a uniform float in [0, 1)
+		if float64(binary.BigEndian.Uint64(b[:])>>11)/(1<<53) >= l.rate {
+			return
+		}
+	}
+	d := l.delay
+	if l.jitter > 0 {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(2*l.jitter)+1))
+		if err == nil {
+			d += time.Duration(n.Int64()) - l.jitter
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// passthrough reports whether q should be answered by tailscaled's MagicDNS
+// resolver under -magicdns-passthrough: names in the primary tailnet domain,
+// except those with a local override (DNAME, weighted record) and the
+// underscore names this proxy synthesizes itself, such as _config.
+func (s *DNSServer) passthrough(q dns.Question) bool {
+	if !s.magicDNS {
+		return false
+	}
+	name := strings.ToLower(dns.Fqdn(q.Name))
+	if !dns.IsSubDomain(dns.Fqdn(s.domain), name) || strings.HasPrefix(name, "_") {
+		return false
+	}
+	if _, _, ok := s.dnames.match(name); ok {
+		return false
+	}
+	_, ok := s.weighted[dnsname.TrimSuffix(name, ".")]
+	return !ok
+}
+
+// handleMagicDNS resolves r with tailscaled's own resolver, the one that
+// answers on 100.100.100.100 for every tailnet member, through the LocalAPI.
+// The tsnet node has no interface to reach that address on directly.
+func (s *DNSServer) handleMagicDNS(w dns.ResponseWriter, r, m *dns.Msg) {
+	q := r.Question[0]
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := s.queryMagicDNS(ctx, q)
+	if err != nil {
+		log.Printf("Error resolving %s with MagicDNS: %v", q.Name, err)
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	if s.debug {
+		log.Printf("MagicDNS answered %s %s: %s", q.Name, dns.TypeToString[q.Qtype], dns.RcodeToString[resp.Rcode])
+	}
+
+	resp.Id = r.Id
+	if s.applyResponsePolicy(resp) {
+		w.WriteMsg(resp)
+	}
+}
+
+// queryMagicDNS sends q to tailscaled's resolver and returns its reply.
+func (s *DNSServer) queryMagicDNS(ctx context.Context, q dns.Question) (*dns.Msg, error) {
+	lc, err := s.tsnet.LocalClient()
+	if err != nil {
+		return nil, err
+	}
+	packed, _, err := lc.QueryDNS(ctx, q.Name, dns.TypeToString[q.Qtype])
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(packed); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+
+	"tailscale.com/metrics"
+	"tailscale.com/tsweb/varz"
+)
+
+// Metrics are published as expvars and exported in Prometheus format by
+// varz, which derives the metric type from the counter_/gauge_ prefix.
+var (
+	metricAXFRTransfers = new(expvar.Int)
+	metricIXFRTransfers = new(expvar.Int)
+	metricProbeFailures = &metrics.LabelMap{Label: "peer"}
+	metricRRLTruncated  = new(expvar.Int)
+	metricRRLDropped    = new(expvar.Int)
+
+	metricHealthCheckFailures = &metrics.LabelMap{Label: "peer"}
+
+	// Occupied -max-concurrent-queries slots, and queries that timed out
+	// waiting for one
+	metricQueuedQueries   = new(expvar.Int)
+	metricRejectedQueries = new(expvar.Int)
+
+	// Latencies in seconds of asking tailscaled for the peer list, on a
+	// network map or engine update or for a query while the IPN bus is not
+	// watched, and of searching the peer list for a queried name
+	metricStatusFetch = newTimingHistogram([]float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5})
+	metricPeerMatch   = newTimingHistogram([]float64{.00001, .00005, .0001, .00025, .0005, .001, .0025, .005, .01})
+
+	// Seconds from a network map update to the stored status reflecting it
+	metricPeerUpdateLatency = newTimingHistogram([]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1})
+
+	// Clients repeatedly getting NXDOMAIN for the same name
+	metricNXDomainStorms = new(expvar.Int)
+
+	// Peer lifecycle events not delivered to a -webhook-url after every
+	// retry, or dropped because its queue was full
+	metricWebhookFailures = new(expvar.Int)
+)
+
+func init() {
+	expvar.Publish("counter_tsmagicproxy_axfr_transfers_total", metricAXFRTransfers)
+	expvar.Publish("counter_tsmagicproxy_ixfr_transfers_total", metricIXFRTransfers)
+	expvar.Publish("counter_tsmagicproxy_probe_failures_total", metricProbeFailures)
+	expvar.Publish("counter_tsmagicproxy_health_check_failures_total", metricHealthCheckFailures)
+	expvar.Publish("counter_tsmagicproxy_rrl_truncated_total", metricRRLTruncated)
+	expvar.Publish("counter_tsmagicproxy_rrl_dropped_total", metricRRLDropped)
+	expvar.Publish("gauge_tsmagicproxy_queued_queries", metricQueuedQueries)
+	expvar.Publish("counter_tsmagicproxy_rejected_queries_total", metricRejectedQueries)
+	publishHistogram("histogram_tsmagicproxy_status_fetch_seconds", metricStatusFetch)
+	publishHistogram("histogram_tsmagicproxy_peer_match_seconds", metricPeerMatch)
+	publishHistogram("histogram_tsmagicproxy_peer_update_latency_seconds", metricPeerUpdateLatency)
+	expvar.Publish("counter_tsmagicproxy_nxdomain_storms_total", metricNXDomainStorms)
+	expvar.Publish("counter_tsmagicproxy_webhook_failures_total", metricWebhookFailures)
+}
+
+// serveMetrics serves Prometheus metrics on addr at /metrics
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", varz.Handler)
+
+	log.Printf("Serving metrics on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
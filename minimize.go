@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// minimizeResponse trims m to what answers its question, as with
+// -response-minimize, so a response carries no records a cache could be
+// poisoned with or that reveal more than was asked. The authority section
+// keeps only the SOA of a negative response, and the additional section
+// only the OPT record and records for names the answer section points to,
+// such as the addresses of an SRV target.
+func minimizeResponse(m *dns.Msg) {
+	negative := m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0)
+	ns := m.Ns[:0]
+	for _, rr := range m.Ns {
+		if _, ok := rr.(*dns.SOA); ok && negative {
+			ns = append(ns, rr)
+		}
+	}
+	m.Ns = ns
+
+	targets := make(map[string]bool)
+	for _, rr := range m.Answer {
+		if target := answerTarget(rr); target != "" {
+			targets[strings.ToLower(target)] = true
+		}
+	}
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT || targets[strings.ToLower(rr.Header().Name)] {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// answerTarget returns the name an answer record points to, whose records
+// may follow in the additional section, or "" if it points to none.
+func answerTarget(rr dns.RR) string {
+	switch rr := rr.(type) {
+	case *dns.NS:
+		return rr.Ns
+	case *dns.SRV:
+		return rr.Target
+	case *dns.MX:
+		return rr.Mx
+	case *dns.CNAME:
+		return rr.Target
+	case *dns.SVCB:
+		return rr.Target
+	case *dns.HTTPS:
+		return rr.Target
+	}
+	return ""
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// startUpstream starts a resolver that answers every query with the given
+// answer, authority and additional records, and returns its address.
+func startUpstream(t *testing.T, answer, ns, extra []string) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parse := func(records []string) []dns.RR {
+		var rrs []dns.RR
+		for _, s := range records {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	handler := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer, m.Ns, m.Extra = parse(answer), parse(ns), parse(extra)
+		w.WriteMsg(m)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(handler), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func TestMinimizeForwardedResponse(t *testing.T) {
+	tests := []struct {
+		name      string
+		qtype     uint16
+		answer    []string
+		ns, extra []string
+		wantNs    int
+		wantExtra []string
+	}{
+		{
+			name:      "glue stripped",
+			qtype:     dns.TypeA,
+			answer:    []string{"example.com. 300 IN A 192.0.2.1"},
+			ns:        []string{"example.com. 300 IN NS ns1.example.com."},
+			extra:     []string{"ns1.example.com. 300 IN A 192.0.2.53"},
+			wantNs:    0,
+			wantExtra: nil,
+		},
+		{
+			name:      "target addresses kept",
+			qtype:     dns.TypeSRV,
+			answer:    []string{"example.com. 300 IN SRV 0 0 443 host.example.com."},
+			ns:        []string{"example.com. 300 IN NS ns1.example.com."},
+			extra:     []string{"host.example.com. 300 IN A 192.0.2.2", "ns1.example.com. 300 IN A 192.0.2.53"},
+			wantNs:    0,
+			wantExtra: []string{"host.example.com."},
+		},
+		{
+			name:   "negative keeps SOA",
+			qtype:  dns.TypeA,
+			ns:     []string{"example.com. 300 IN SOA ns1.example.com. admin.example.com. 1 7200 3600 1209600 300", "example.com. 300 IN NS ns1.example.com."},
+			extra:  []string{"ns1.example.com. 300 IN A 192.0.2.53"},
+			wantNs: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStaticTestServer(t)
+			s.outOfZone = policyForward
+			s.upstreams = []string{startUpstream(t, tt.answer, tt.ns, tt.extra)}
+
+			m := query(t, s, "example.com.", tt.qtype)
+			if len(m.Answer) != len(tt.answer) {
+				t.Fatalf("answers = %v, want %v", m.Answer, tt.answer)
+			}
+			if len(m.Ns) != tt.wantNs {
+				t.Errorf("authority = %v, want %d records", m.Ns, tt.wantNs)
+			}
+			if len(m.Extra) != len(tt.wantExtra) {
+				t.Fatalf("additional = %v, want records for %v", m.Extra, tt.wantExtra)
+			}
+			for i, rr := range m.Extra {
+				if rr.Header().Name != tt.wantExtra[i] {
+					t.Errorf("additional %d = %s, want a record for %s", i, rr, tt.wantExtra[i])
+				}
+			}
+
+			// Without minimization the upstream's response is passed on whole
+			s.minimal = false
+			m = query(t, s, "example.com.", tt.qtype)
+			if len(m.Ns) != len(tt.ns) || len(m.Extra) != len(tt.extra) {
+				t.Errorf("unminimized response = %v, want every upstream record", m)
+			}
+		})
+	}
+}
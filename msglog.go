@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dnsMsgToMap converts m to a map of its sections, so -debug responses are
+// logged as structured fields with -log-format json rather than as the
+// zone-file style text of dns.Msg.String.
+func dnsMsgToMap(m *dns.Msg) map[string]any {
+	questions := make([]map[string]any, 0, len(m.Question))
+	for _, q := range m.Question {
+		questions = append(questions, map[string]any{
+			"name":  q.Name,
+			"type":  dns.TypeToString[q.Qtype],
+			"class": dns.ClassToString[q.Qclass],
+		})
+	}
+	return map[string]any{
+		"id":         m.Id,
+		"rcode":      dns.RcodeToString[m.Rcode],
+		"question":   questions,
+		"answer":     dnsRRsToMaps(m.Answer),
+		"authority":  dnsRRsToMaps(m.Ns),
+		"additional": dnsRRsToMaps(m.Extra),
+	}
+}
+
+func dnsRRsToMaps(rrs []dns.RR) []map[string]any {
+	maps := make([]map[string]any, 0, len(rrs))
+	for _, rr := range rrs {
+		maps = append(maps, dnsRRToMap(rr))
+	}
+	return maps
+}
+
+// dnsRRToMap converts rr to its name, type, TTL and record data, the data
+// in presentation format as it appears after the header in rr.String.
+func dnsRRToMap(rr dns.RR) map[string]any {
+	hdr := rr.Header()
+	return map[string]any{
+		"name":  hdr.Name,
+		"type":  dns.TypeToString[hdr.Rrtype],
+		"ttl":   hdr.Ttl,
+		"rdata": strings.TrimPrefix(rr.String(), hdr.String()),
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/util/dnsname"
+)
+
+// handleNAPTRQuery answers a NAPTR query for a peer with one record per ACL
+// tag, pointing at the _<tag>._tcp SRV name of the peer, so tags can drive
+// NAPTR and SRV based service discovery (RFC 3403).
+func (s *DNSServer) handleNAPTRQuery(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	status, err := s.fetchStatus()
+	if err != nil {
+		qlog.Error("Error getting status", "err", err)
+		return
+	}
+	peer := s.findPeer(status, dnsname.TrimSuffix(q.Name, "."), qlog)
+	if peer == nil || peer.Tags == nil {
+		return
+	}
+
+	for _, tag := range peer.Tags.All() {
+		service := strings.TrimPrefix(tag, "tag:")
+		m.Answer = append(m.Answer, &dns.NAPTR{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeNAPTR,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(*ttl),
+			},
+			Order:       100,
+			Preference:  10,
+			Flags:       "s",
+			Service:     service,
+			Replacement: "_" + service + "._tcp." + dns.Fqdn(peer.DNSName),
+		})
+	}
+}
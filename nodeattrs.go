@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/util/dnsname"
+)
+
+// nodeAttrPrefix starts the node attributes that publish DNS records, e.g.
+// "dns.tsmagicproxy/txt-owner=alice" or "dns.tsmagicproxy/srv-ssh=22".
+const nodeAttrPrefix = "dns.tsmagicproxy/"
+
+// nodeAttrRecords returns the TXT strings and SRV ports, by service name,
+// that peer's node attributes publish. An attribute's value may follow an
+// "=" in its name, as nodeAttrs in the policy file give it, or be carried
+// as JSON string values of the capability.
+func nodeAttrRecords(peer *ipnstate.PeerStatus) (txt []string, srv map[string]uint16) {
+	srv = make(map[string]uint16)
+	for capability, raw := range peer.CapMap {
+		attr, ok := strings.CutPrefix(string(capability), nodeAttrPrefix)
+		if !ok {
+			continue
+		}
+		for _, v := range nodeAttrValues(attr, raw) {
+			key, value := v[0], v[1]
+			switch {
+			case strings.HasPrefix(key, "txt-"):
+				txt = append(txt, strings.TrimPrefix(key, "txt-")+"="+value)
+			case strings.HasPrefix(key, "srv-"):
+				port, err := strconv.ParseUint(value, 10, 16)
+				if err != nil || port == 0 {
+					log.Printf("Invalid port in node attribute %s of %s", capability, peer.DNSName)
+					continue
+				}
+				srv[strings.ToLower(strings.TrimPrefix(key, "srv-"))] = uint16(port)
+			}
+		}
+	}
+	sort.Strings(txt)
+	return txt, srv
+}
+
+// nodeAttrValues splits an attribute, without the prefix, into key and
+// value pairs.
+func nodeAttrValues(attr string, raw []tailcfg.RawMessage) [][2]string {
+	if key, value, ok := strings.Cut(attr, "="); ok {
+		return [][2]string{{key, value}}
+	}
+	var pairs [][2]string
+	for _, r := range raw {
+		var value string
+		if err := json.Unmarshal([]byte(r), &value); err == nil {
+			pairs = append(pairs, [2]string{attr, value})
+		}
+	}
+	return pairs
+}
+
+// nodeAttrPeer returns this node or the peer named name, without trailing
+// dot.
+func (s *DNSServer) nodeAttrPeer(status *ipnstate.Status, name string, qlog *slog.Logger) *ipnstate.PeerStatus {
+	if s.isSelf(status, name) {
+		return status.Self
+	}
+	return s.findPeer(status, name, qlog)
+}
+
+// addNodeAttrTXT answers a TXT query for a peer with the records its
+// dns.tsmagicproxy/txt-* node attributes publish.
+func (s *DNSServer) addNodeAttrTXT(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	status, err := s.fetchStatus()
+	if err != nil {
+		qlog.Error("Error getting status", "err", err)
+		return
+	}
+	peer := s.nodeAttrPeer(status, strings.ToLower(dnsname.TrimSuffix(q.Name, ".")), qlog)
+	if peer == nil {
+		return
+	}
+	txt, _ := nodeAttrRecords(peer)
+	for _, t := range txt {
+		m.Answer = append(m.Answer, txtRR(q.Name, uint32(*ttl), t))
+	}
+}
+
+// handleNodeAttrSRV answers _<service>._tcp.<name> from the peer's
+// dns.tsmagicproxy/srv-<service> node attribute. It reports whether the
+// peer publishes the service.
+func (s *DNSServer) handleNodeAttrSRV(q dns.Question, m *dns.Msg, qlog *slog.Logger) bool {
+	service, name, ok := strings.Cut(strings.TrimSuffix(strings.ToLower(q.Name), "."), "._tcp.")
+	if !ok || !strings.HasPrefix(service, "_") {
+		return false
+	}
+
+	status, err := s.fetchStatus()
+	if err != nil {
+		qlog.Error("Error getting status", "err", err)
+		return false
+	}
+	peer := s.nodeAttrPeer(status, name, qlog)
+	if peer == nil {
+		return false
+	}
+	_, srv := nodeAttrRecords(peer)
+	port, ok := srv[strings.TrimPrefix(service, "_")]
+	if !ok {
+		return false
+	}
+
+	m.Answer = append(m.Answer, &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(*ttl),
+		},
+		Port:   port,
+		Target: dns.Fqdn(peer.DNSName),
+	})
+	return true
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// notifyAttempts bounds the NOTIFY messages sent to each secondary for one
+// zone change.
+const notifyAttempts = 3
+
+// watchZone sends a NOTIFY to every secondary whenever a status update
+// changes the tailnet zone's records, and once at startup.
+func (s *DNSServer) watchZone(secondaries []string) {
+	if s.domain == "" {
+		log.Printf("No domain configured or detected, not sending NOTIFY")
+		return
+	}
+	updates := s.updates.subscribe()
+	var last uint32
+	for ; ; <-updates {
+		status := s.status.Load()
+		soa := s.soaRecord(status, zoneRecords(status, s.domain, *ttl))
+		if soa.Serial == last {
+			continue
+		}
+		last = soa.Serial
+		log.Printf("Zone %s changed, notifying secondaries of serial %d", soa.Hdr.Name, soa.Serial)
+		for _, addr := range secondaries {
+			go notifySecondary(addr, soa)
+		}
+	}
+}
+
+// notifySecondary sends a NOTIFY for soa's zone to addr, retrying failures.
+func notifySecondary(addr string, soa *dns.SOA) {
+	m := new(dns.Msg)
+	m.SetNotify(soa.Hdr.Name)
+	m.Answer = []dns.RR{soa}
+
+	c := new(dns.Client)
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		err := exchangeNotify(c, m, addr)
+		if err == nil {
+			return
+		}
+		log.Printf("NOTIFY to %s failed (attempt %d/%d): %v", addr, attempt, notifyAttempts, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// exchangeNotify sends one NOTIFY and checks the secondary acknowledged it.
+func exchangeNotify(c *dns.Client, m *dns.Msg, addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, _, err := c.ExchangeContext(ctx, m, addr)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("secondary answered %s", dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
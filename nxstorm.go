@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// nxStormKey identifies a repeated query for a nonexistent name.
+type nxStormKey struct {
+	client netip.Addr
+	qname  string
+	qtype  uint16
+}
+
+// nxStormEntry holds the times of the latest NXDOMAIN answers for one key
+// in a circular buffer with room for one threshold's worth, so the history
+// kept per key is bounded.
+type nxStormEntry struct {
+	times   []time.Time
+	next    int       // index of the oldest time once the buffer is full
+	alerted time.Time // last storm logged for the key
+}
+
+// nxStormDetector logs a warning when a client gets NXDOMAIN for the same
+// name and type more than -nxdomain-alert-threshold times within
+// -nxdomain-alert-window, as misconfigured applications do when they poll
+// for names like kubernetes.default.svc.cluster.local.
+type nxStormDetector struct {
+	threshold int
+	window    time.Duration
+
+	mu        sync.Mutex
+	entries   map[nxStormKey]*nxStormEntry
+	lastSweep time.Time
+}
+
+func newNXStormDetector(threshold int, window time.Duration) *nxStormDetector {
+	return &nxStormDetector{
+		threshold: threshold,
+		window:    window,
+		entries:   make(map[nxStormKey]*nxStormEntry),
+	}
+}
+
+// observe records an NXDOMAIN answer for key and logs a storm when the
+// threshold is crossed, at most once per window for each key.
+func (d *nxStormDetector) observe(key nxStormKey) {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep(now)
+
+	e, ok := d.entries[key]
+	if !ok {
+		e = &nxStormEntry{times: make([]time.Time, 0, d.threshold)}
+		d.entries[key] = e
+	}
+	if len(e.times) < d.threshold {
+		e.times = append(e.times, now)
+		return
+	}
+	// The buffer is full: the oldest time is a threshold ago in answers,
+	// so if it is within the window this answer is one too many
+	oldest := e.times[e.next]
+	e.times[e.next] = now
+	e.next = (e.next + 1) % d.threshold
+	if now.Sub(oldest) > d.window || now.Sub(e.alerted) < d.window {
+		return
+	}
+	e.alerted = now
+	metricNXDomainStorms.Add(1)
+	slog.Warn("Repeated queries for a nonexistent name",
+		"event", "nxdomain_storm",
+		"client", key.client,
+		"name", key.qname,
+		"type", dns.TypeToString[key.qtype],
+		"count", d.threshold+1)
+}
+
+// sweep forgets keys with no NXDOMAIN answer within the window, so the map
+// does not grow with every name ever queried. d.mu must be held.
+func (d *nxStormDetector) sweep(now time.Time) {
+	if now.Sub(d.lastSweep) < d.window {
+		return
+	}
+	d.lastSweep = now
+	for key, e := range d.entries {
+		latest := (e.next + len(e.times) - 1) % len(e.times)
+		if now.Sub(e.times[latest]) > d.window {
+			delete(d.entries, key)
+		}
+	}
+}
+
+// nxStormWriter reports the NXDOMAIN answers written through it to a
+// nxStormDetector.
+type nxStormWriter struct {
+	dns.ResponseWriter
+	detector *nxStormDetector
+}
+
+func (w nxStormWriter) WriteMsg(m *dns.Msg) error {
+	if m.Rcode == dns.RcodeNameError && len(m.Question) == 1 {
+		q := m.Question[0]
+		w.detector.observe(nxStormKey{
+			client: extractClientIP(w.RemoteAddr()),
+			qname:  dns.CanonicalName(q.Name),
+			qtype:  q.Qtype,
+		})
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
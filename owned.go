@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+)
+
+// parseOwnedZones parses the -owned-zones flag into lowercase FQDNs,
+// accepting only reverse zones under in-addr.arpa or ip6.arpa.
+func parseOwnedZones(s string) ([]string, error) {
+	var zones []string
+	for _, z := range splitList(s) {
+		z = strings.ToLower(dns.Fqdn(z))
+		if _, ok := dns.IsDomainName(z); !ok {
+			return nil, fmt.Errorf("%q is not a valid zone name", z)
+		}
+		if !dns.IsSubDomain("in-addr.arpa.", z) && !dns.IsSubDomain("ip6.arpa.", z) {
+			return nil, fmt.Errorf("%q is not a reverse zone under in-addr.arpa or ip6.arpa", z)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// mustParseOwnedZones is like parseOwnedZones but for a flag that has
+// already passed validateConfig.
+func mustParseOwnedZones(s string) []string {
+	zones, err := parseOwnedZones(s)
+	if err != nil {
+		panic(err)
+	}
+	return zones
+}
+
+// ownedZone returns the most specific -owned-zones zone containing name.
+func (s *DNSServer) ownedZone(name string) (string, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	var owner string
+	for _, z := range s.ownedZones {
+		if dns.IsSubDomain(z, name) && len(z) > len(owner) {
+			owner = z
+		}
+	}
+	return owner, owner != ""
+}
+
+// handleSOAQuery answers an SOA query for the apex of an owned zone.
+func (s *DNSServer) handleSOAQuery(q dns.Question, m *dns.Msg) {
+	zone, ok := s.ownedZone(q.Name)
+	if !ok || !strings.EqualFold(dns.Fqdn(q.Name), zone) {
+		return
+	}
+	m.Answer = append(m.Answer, s.ownedSOA(s.status.Load(), zone))
+}
+
+// addOwnedZoneAuthority completes an empty answer for a name in an owned
+// zone as an authoritative negative response (RFC 2308): NXDOMAIN unless
+// the name is the apex or lies at or above a peer's reverse name, and in
+// either case the zone's SOA in the authority section.
+func (s *DNSServer) addOwnedZoneAuthority(q dns.Question, m *dns.Msg) {
+	zone, ok := s.ownedZone(q.Name)
+	if !ok || len(m.Answer) > 0 || m.Rcode != dns.RcodeSuccess {
+		return
+	}
+	status := s.status.Load()
+	if !strings.EqualFold(dns.Fqdn(q.Name), zone) && !reverseNameExists(status, q.Name) {
+		m.Rcode = dns.RcodeNameError
+	}
+	m.Ns = append(m.Ns, s.ownedSOA(status, zone))
+}
+
+// reverseNameExists reports whether name is the reverse name of a peer's
+// or this node's Tailscale IP, or an ancestor of one.
+func reverseNameExists(status *ipnstate.Status, name string) bool {
+	for _, peer := range peersAndSelf(status) {
+		if peer.DNSName == "" {
+			continue
+		}
+		for _, addr := range peer.TailscaleIPs {
+			if reverse, err := dns.ReverseAddr(addr.String()); err == nil && dns.IsSubDomain(name, reverse) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ownedSOA returns the SOA record of an owned zone. Its serial follows the
+// tailnet zone, whose PTR records it holds.
+func (s *DNSServer) ownedSOA(status *ipnstate.Status, zone string) *dns.SOA {
+	soa := s.soaRecord(status, zoneRecords(status, s.domain, *ttl))
+	soa.Hdr.Name = zone
+	return soa
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// upstreamCheckTimeout bounds the test query sent to each upstream at
+// startup.
+const upstreamCheckTimeout = 2 * time.Second
+
+// checkDependencies checks, before connecting to the tailnet or serving
+// DNS, that the directories the proxy writes to are writable and that the
+// upstreams answer. Unlike validateConfig it touches the filesystem and the
+// network. Every failure is returned, so all of them can be fixed at once.
+func (s *DNSServer) checkDependencies() []error {
+	var errs []error
+
+	if s.staticPeers == "" {
+		// startTailnet creates the state directory too
+		err := os.MkdirAll(*stateDir, 0700)
+		if err == nil {
+			err = checkWritableDir(*stateDir)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("-state-dir: %w", err))
+		}
+	}
+	if *zoneFile != "" {
+		if err := checkWritableDir(filepath.Dir(*zoneFile)); err != nil {
+			errs = append(errs, fmt.Errorf("-zone-file: %w", err))
+		}
+	}
+	for _, addr := range s.upstreams {
+		if err := s.checkUpstream(addr); err != nil {
+			errs = append(errs, fmt.Errorf("-upstream %s: %w", addr, err))
+		}
+	}
+	for _, qtype := range slices.Sorted(maps.Keys(s.typeUpstreams)) {
+		for _, addr := range s.typeUpstreams[qtype] {
+			if err := s.checkUpstream(addr); err != nil {
+				errs = append(errs, fmt.Errorf("-type-upstream %s=%s: %w", dns.TypeToString[qtype], addr, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkWritableDir checks a file can be created in dir.
+func checkWritableDir(dir string) error {
+	probe := filepath.Join(dir, "probe")
+	f, err := os.OpenFile(probe, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("directory is not writable: %w", err)
+	}
+	f.Close()
+	return os.Remove(probe)
+}
+
+// checkUpstream sends an NS query for the root zone to addr. Any answer,
+// whatever its rcode, shows the upstream is reachable.
+func (s *DNSServer) checkUpstream(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamCheckTimeout)
+	defer cancel()
+
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeNS)
+	if _, err := s.exchangeUpstream(ctx, m, addr, "udp"); err != nil {
+		return fmt.Errorf("not reachable: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+// probeConcurrency bounds the number of peers dialed at once.
+const probeConcurrency = 16
+
+// peerProber periodically dials every peer over the tailnet and remembers
+// which ones answered, so unreachable peers can be left out of answers.
+type peerProber struct {
+	port int
+	ttl  time.Duration
+
+	mu     sync.Mutex
+	lastOK map[tailcfg.StableNodeID]time.Time
+}
+
+func newPeerProber(port int, ttl time.Duration) *peerProber {
+	return &peerProber{
+		port:   port,
+		ttl:    ttl,
+		lastOK: make(map[tailcfg.StableNodeID]time.Time),
+	}
+}
+
+// reachable reports whether peer passed a probe within the probe TTL.
+func (p *peerProber) reachable(peer *ipnstate.PeerStatus) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, ok := p.lastOK[peer.ID]
+	return ok && time.Since(last) < p.ttl
+}
+
+// run probes all peers every half probe TTL, so a reachable peer is never
+// considered stale between rounds.
+func (p *peerProber) run(s *DNSServer) {
+	ticker := time.NewTicker(p.ttl / 2)
+	defer ticker.Stop()
+	for {
+		status, err := s.fetchStatus()
+		if err != nil {
+			log.Printf("Error getting status for probes: %v", err)
+		} else {
+			p.probeAll(s, status)
+		}
+		<-ticker.C
+	}
+}
+
+// probeAll dials each peer's first Tailscale IP on the probe port.
+func (p *peerProber) probeAll(s *DNSServer, status *ipnstate.Status) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, probeConcurrency)
+	for _, peer := range status.Peer {
+		if len(peer.TailscaleIPs) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			p.probe(s, peer)
+		}()
+	}
+	wg.Wait()
+}
+
+func (p *peerProber) probe(s *DNSServer, peer *ipnstate.PeerStatus) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	addr := netip.AddrPortFrom(peer.TailscaleIPs[0], uint16(p.port)).String()
+	conn, err := s.tsnet.Dial(ctx, "tcp", addr)
+	if err != nil {
+		if s.debug {
+			log.Printf("Probe of %s (%s) failed: %v", peer.DNSName, addr, err)
+		}
+		metricProbeFailures.Add(peer.DNSName, 1)
+		return
+	}
+	conn.Close()
+
+	p.mu.Lock()
+	p.lastOK[peer.ID] = time.Now()
+	p.mu.Unlock()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxReferrals bounds the delegations followed when resolving the
+	// full query name.
+	maxReferrals = 16
+
+	// maxNSDepth bounds nested resolutions of glueless nameserver names.
+	maxNSDepth = 3
+)
+
+// resolveMinimized resolves r iteratively starting from the upstreams, which
+// are expected to be root or otherwise authoritative servers. Each server is
+// only asked for an NS record one label longer than the zone it serves, so
+// the full query name is revealed to the final authoritative server alone
+// (RFC 7816). CNAME targets in the final answer are not chased.
+func (s *DNSServer) resolveMinimized(ctx context.Context, r *dns.Msg, network string) (*dns.Msg, error) {
+	c := &dns.Client{Net: network}
+	resp, err := s.iterate(ctx, c, r, s.upstreams, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = r.Id
+	resp.RecursionDesired = r.RecursionDesired
+	resp.RecursionAvailable = true
+	resp.Authoritative = false
+	return resp, nil
+}
+
+// iterate walks down from the root towards r's question name, following
+// delegations from servers, and returns the final server's response.
+func (s *DNSServer) iterate(ctx context.Context, c *dns.Client, r *dns.Msg, servers []string, depth int) (*dns.Msg, error) {
+	if depth > maxNSDepth {
+		return nil, errors.New("nameserver resolution nested too deeply")
+	}
+
+	q := r.Question[0]
+	labels := dns.SplitDomainName(q.Name)
+	zone := "."
+
+	// Discover zone cuts one label at a time, stopping short of the full name
+	for i := len(labels) - 1; i > 0; i-- {
+		name := dns.Fqdn(strings.Join(labels[i:], "."))
+		probe := new(dns.Msg)
+		probe.SetQuestion(name, dns.TypeNS)
+		probe.RecursionDesired = false
+
+		resp, err := exchangeAny(ctx, c, probe, servers)
+		if err != nil {
+			return nil, err
+		}
+		if resp.Rcode == dns.RcodeNameError {
+			// Nothing exists below a nonexistent name (RFC 8020)
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNameError)
+			m.Ns = resp.Ns
+			return m, nil
+		}
+		if cut, ns := delegation(resp, zone); cut != "" {
+			next, err := s.nameserverAddrs(ctx, c, resp, ns, depth)
+			if err != nil {
+				return nil, err
+			}
+			zone, servers = cut, next
+		}
+	}
+
+	// Ask for the full name, following any remaining referrals
+	full := r.Copy()
+	full.RecursionDesired = false
+	for range maxReferrals {
+		resp, err := exchangeAny(ctx, c, full, servers)
+		if err != nil {
+			return nil, err
+		}
+		cut, ns := delegation(resp, zone)
+		if cut == "" || len(resp.Answer) > 0 {
+			return resp, nil
+		}
+		next, err := s.nameserverAddrs(ctx, c, resp, ns, depth)
+		if err != nil {
+			return nil, err
+		}
+		zone, servers = cut, next
+	}
+	return nil, errors.New("too many referrals")
+}
+
+// delegation returns the zone cut below zone described by the NS records in
+// resp, along with the nameserver names, or "" if resp is not a delegation.
+func delegation(resp *dns.Msg, zone string) (string, []string) {
+	if resp.Rcode != dns.RcodeSuccess {
+		return "", nil
+	}
+	var cut string
+	var ns []string
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		rec, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		name := strings.ToLower(rec.Hdr.Name)
+		if name == strings.ToLower(zone) || !dns.IsSubDomain(zone, name) {
+			continue
+		}
+		if cut == "" {
+			cut = name
+		}
+		if name == cut {
+			ns = append(ns, rec.Ns)
+		}
+	}
+	return cut, ns
+}
+
+// nameserverAddrs returns host:port addresses for the nameservers ns, using
+// glue from resp where present and resolving them from the upstreams
+// otherwise.
+func (s *DNSServer) nameserverAddrs(ctx context.Context, c *dns.Client, resp *dns.Msg, ns []string, depth int) ([]string, error) {
+	var addrs []string
+	for _, rr := range resp.Extra {
+		for _, name := range ns {
+			if !strings.EqualFold(rr.Header().Name, name) {
+				continue
+			}
+			switch rec := rr.(type) {
+			case *dns.A:
+				addrs = append(addrs, net.JoinHostPort(rec.A.String(), "53"))
+			case *dns.AAAA:
+				addrs = append(addrs, net.JoinHostPort(rec.AAAA.String(), "53"))
+			}
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	for _, name := range ns {
+		lookup := new(dns.Msg)
+		lookup.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		resp, err := s.iterate(ctx, c, lookup, s.upstreams, depth+1)
+		if err != nil {
+			continue
+		}
+		for _, rr := range resp.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				addrs = append(addrs, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, errors.New("no address found for delegated nameservers")
+}
+
+// exchangeAny sends m to each server in turn and returns the first response.
+func exchangeAny(ctx context.Context, c *dns.Client, m *dns.Msg, servers []string) (*dns.Msg, error) {
+	err := errors.New("no nameservers")
+	for _, addr := range servers {
+		var resp *dns.Msg
+		resp, _, err = c.ExchangeContext(ctx, m, addr)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
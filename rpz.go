@@ -0,0 +1,334 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rpzAction is what a response policy zone rule does to a matching query.
+type rpzAction int
+
+const (
+	rpzNXDomain rpzAction = iota // CNAME .
+	rpzNoData                    // CNAME *.
+	rpzDrop                      // CNAME rpz-drop.
+	rpzPassthru                  // CNAME rpz-passthru.
+	rpzRedirect                  // local A/AAAA data
+)
+
+func (a rpzAction) String() string {
+	switch a {
+	case rpzNXDomain:
+		return "NXDOMAIN"
+	case rpzNoData:
+		return "NODATA"
+	case rpzDrop:
+		return "drop"
+	case rpzPassthru:
+		return "passthru"
+	case rpzRedirect:
+		return "redirect"
+	}
+	return "unknown"
+}
+
+// rpzRule is the action for one trigger, with the addresses to answer with
+// for rpzRedirect.
+type rpzRule struct {
+	action   rpzAction
+	redirect []netip.Addr
+}
+
+// rpzIPRule is a response-IP trigger.
+type rpzIPRule struct {
+	prefix netip.Prefix
+	rule   *rpzRule
+}
+
+// rpzPolicy is a parsed response policy zone. Only QNAME and response-IP
+// triggers are supported.
+type rpzPolicy struct {
+	qnames map[string]*rpzRule // lowercase FQDN, "*." prefix for wildcards
+	ips    []rpzIPRule
+}
+
+// loadRPZ reads a response policy zone from -rpz-file or -rpz-url.
+func loadRPZ() (*rpzPolicy, error) {
+	var r io.Reader
+	source := *rpzFile
+	if *rpzURL != "" {
+		source = *rpzURL
+		c := &http.Client{Timeout: 30 * time.Second}
+		resp, err := c.Get(*rpzURL)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("fetching %s: %s", *rpzURL, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(*rpzFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	return parseRPZ(r, source)
+}
+
+// parseRPZ parses an RPZ zone in RFC 1035 format. Trigger names are taken
+// relative to the owner of the zone's SOA record.
+func parseRPZ(r io.Reader, source string) (*rpzPolicy, error) {
+	var records []dns.RR
+	origin := ""
+	zp := dns.NewZoneParser(r, "", source)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		if soa, isSOA := rr.(*dns.SOA); isSOA && origin == "" {
+			origin = strings.ToLower(soa.Hdr.Name)
+		}
+		records = append(records, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+	if origin == "" {
+		return nil, errors.New("RPZ zone has no SOA record")
+	}
+
+	p := &rpzPolicy{qnames: make(map[string]*rpzRule)}
+	ipRules := make(map[netip.Prefix]*rpzRule)
+	for _, rr := range records {
+		owner := strings.ToLower(rr.Header().Name)
+		if owner == origin || !dns.IsSubDomain(origin, owner) {
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, origin)
+
+		var rule *rpzRule
+		if ipTrigger, ok := strings.CutSuffix(trigger, "rpz-ip."); ok {
+			prefix, err := parseRPZIP(ipTrigger)
+			if err != nil {
+				log.Printf("Skipping RPZ trigger %s: %v", owner, err)
+				continue
+			}
+			if rule = ipRules[prefix]; rule == nil {
+				rule = new(rpzRule)
+				ipRules[prefix] = rule
+				p.ips = append(p.ips, rpzIPRule{prefix, rule})
+			}
+		} else if strings.Contains(trigger, ".rpz-") || strings.HasPrefix(trigger, "rpz-") {
+			log.Printf("Skipping unsupported RPZ trigger %s", owner)
+			continue
+		} else {
+			if rule = p.qnames[trigger]; rule == nil {
+				rule = new(rpzRule)
+				p.qnames[trigger] = rule
+			}
+		}
+
+		if err := rule.add(rr); err != nil {
+			log.Printf("Skipping RPZ record %s: %v", owner, err)
+		}
+	}
+	return p, nil
+}
+
+// add merges the action encoded by rr into the rule.
+func (r *rpzRule) add(rr dns.RR) error {
+	switch rec := rr.(type) {
+	case *dns.CNAME:
+		switch strings.ToLower(rec.Target) {
+		case ".":
+			r.action = rpzNXDomain
+		case "*.":
+			r.action = rpzNoData
+		case "rpz-drop.":
+			r.action = rpzDrop
+		case "rpz-passthru.":
+			r.action = rpzPassthru
+		default:
+			return fmt.Errorf("unsupported CNAME action %s", rec.Target)
+		}
+	case *dns.A:
+		addr, _ := netip.AddrFromSlice(rec.A)
+		r.action = rpzRedirect
+		r.redirect = append(r.redirect, addr.Unmap())
+	case *dns.AAAA:
+		addr, _ := netip.AddrFromSlice(rec.AAAA)
+		r.action = rpzRedirect
+		r.redirect = append(r.redirect, addr)
+	default:
+		return fmt.Errorf("unsupported record type %s", dns.TypeToString[rr.Header().Rrtype])
+	}
+	return nil
+}
+
+// parseRPZIP parses the labels of a response-IP trigger, such as
+// "32.1.0.0.127." for 127.0.0.1/32 or "128.1.zz.3.db8.2001." for
+// 2001:db8:3::1/128.
+func parseRPZIP(trigger string) (netip.Prefix, error) {
+	labels := dns.SplitDomainName(trigger)
+	if len(labels) < 2 {
+		return netip.Prefix{}, errors.New("too few labels")
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid prefix length %q", labels[0])
+	}
+	parts := labels[1:]
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+
+	ip := strings.Join(parts, ".")
+	if len(parts) != 4 {
+		// IPv6 groups, with "zz" standing in for "::"
+		ip = strings.Replace(strings.Join(parts, ":"), "zz", "", 1)
+		if strings.HasPrefix(ip, ":") && !strings.HasPrefix(ip, "::") {
+			ip = ":" + ip
+		}
+		if strings.HasSuffix(ip, ":") && !strings.HasSuffix(ip, "::") {
+			ip += ":"
+		}
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return addr.Prefix(bits)
+}
+
+// matchQName returns the rule for name, preferring an exact trigger over the
+// closest wildcard.
+func (p *rpzPolicy) matchQName(name string) *rpzRule {
+	name = strings.ToLower(dns.Fqdn(name))
+	if rule, ok := p.qnames[name]; ok {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, ok := p.qnames["*."+name[off:]]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// matchIP returns the rule of the most specific response-IP trigger
+// containing addr.
+func (p *rpzPolicy) matchIP(addr netip.Addr) *rpzRule {
+	var best *rpzIPRule
+	for i, r := range p.ips {
+		if r.prefix.Contains(addr) && (best == nil || r.prefix.Bits() > best.prefix.Bits()) {
+			best = &p.ips[i]
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return best.rule
+}
+
+// apply rewrites m for a matched rule and reports whether a response
+// should be sent at all.
+func (r *rpzRule) apply(q dns.Question, m *dns.Msg) bool {
+	switch r.action {
+	case rpzDrop:
+		return false
+	case rpzPassthru:
+		return true
+	case rpzNXDomain:
+		m.Rcode = dns.RcodeNameError
+		addExtendedError(m, dns.ExtendedErrorCodeBlocked, "blocked by response policy")
+	case rpzNoData:
+		m.Rcode = dns.RcodeSuccess
+		addExtendedError(m, dns.ExtendedErrorCodeBlocked, "blocked by response policy")
+	case rpzRedirect:
+		m.Rcode = dns.RcodeSuccess
+		addExtendedError(m, dns.ExtendedErrorCodeForgedAnswer, "rewritten by response policy")
+	}
+	m.Answer = nil
+	m.Ns = nil
+	if r.action == rpzRedirect {
+		for _, addr := range r.redirect {
+			if (q.Qtype == dns.TypeA && addr.Is4()) || (q.Qtype == dns.TypeAAAA && addr.Is6()) {
+				m.Answer = append(m.Answer, createRR(q.Name, addr, *ttl))
+			}
+		}
+	}
+	return true
+}
+
+// applyQNamePolicy applies any QNAME trigger matching the first question of
+// r, writing the rewritten response. It reports whether the query was
+// handled, so normal processing should stop.
+func (s *DNSServer) applyQNamePolicy(w dns.ResponseWriter, r, m *dns.Msg) bool {
+	p := s.rpz.Load()
+	if p == nil || len(r.Question) == 0 {
+		return false
+	}
+	q := r.Question[0]
+	rule := p.matchQName(q.Name)
+	if rule == nil || rule.action == rpzPassthru {
+		return false
+	}
+
+	log.Printf("RPZ QNAME trigger matched %s: %v", q.Name, rule.action)
+	if rule.apply(q, m) {
+		w.WriteMsg(m)
+	}
+	return true
+}
+
+// applyResponsePolicy applies any response-IP trigger matching an address in
+// m's answer section, and reports whether m should still be sent.
+func (s *DNSServer) applyResponsePolicy(m *dns.Msg) bool {
+	p := s.rpz.Load()
+	if p == nil || len(p.ips) == 0 || len(m.Question) == 0 {
+		return true
+	}
+	for _, rr := range m.Answer {
+		var addr netip.Addr
+		switch rec := rr.(type) {
+		case *dns.A:
+			addr, _ = netip.AddrFromSlice(rec.A)
+		case *dns.AAAA:
+			addr, _ = netip.AddrFromSlice(rec.AAAA)
+		default:
+			continue
+		}
+		if rule := p.matchIP(addr.Unmap()); rule != nil {
+			log.Printf("RPZ response-IP trigger matched %s in answer for %s: %v", addr.Unmap(), m.Question[0].Name, rule.action)
+			return rule.apply(m.Question[0], m)
+		}
+	}
+	return true
+}
+
+// refreshRPZ reloads the response policy zone every -rpz-refresh seconds,
+// keeping the previous policy if a reload fails.
+func (s *DNSServer) refreshRPZ() {
+	ticker := time.NewTicker(time.Duration(*rpzRefresh) * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		p, err := loadRPZ()
+		if err != nil {
+			log.Printf("Error reloading RPZ, keeping previous rules: %v", err)
+			continue
+		}
+		s.rpz.Store(p)
+		log.Printf("Reloaded RPZ: %d QNAME and %d response-IP triggers", len(p.qnames), len(p.ips))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// rrlSlip is how often a rate-limited client still gets an answer: one
+	// in every rrlSlip responses is sent truncated, so a real client can
+	// retry over TCP, and the rest are dropped.
+	rrlSlip = 2
+
+	// rrlIPv6PrefixLen groups IPv6 clients, which usually hold a whole
+	// prefix, the way -rrl-prefix-len groups IPv4 clients.
+	rrlIPv6PrefixLen = 56
+
+	// rrlSweepInterval is how often buckets of idle clients are forgotten.
+	rrlSweepInterval = time.Minute
+)
+
+// rrlBucket is the token bucket of one client prefix.
+type rrlBucket struct {
+	tokens  float64
+	last    time.Time // last refill
+	limited int       // responses over the limit, for slipping
+}
+
+// responseLimiter implements DNS response rate limiting, capping the UDP
+// responses sent to each client prefix so the proxy cannot be used to
+// amplify traffic towards spoofed source addresses.
+type responseLimiter struct {
+	rate      float64 // tokens added per second
+	burst     float64 // bucket capacity, the responses allowed per window
+	prefixLen int     // IPv4 prefix length clients are grouped by
+
+	mu        sync.Mutex
+	buckets   map[netip.Prefix]*rrlBucket
+	lastSweep time.Time
+}
+
+func newResponseLimiter(rate int, window time.Duration, prefixLen int) *responseLimiter {
+	return &responseLimiter{
+		rate:      float64(rate),
+		burst:     float64(rate) * window.Seconds(),
+		prefixLen: prefixLen,
+		buckets:   make(map[netip.Prefix]*rrlBucket),
+	}
+}
+
+// limit decides what to do with a response over UDP to addr: send it, send
+// it truncated, or drop it. TCP clients and loopback addresses, which cannot
+// be spoofed from the network, are never limited.
+func (l *responseLimiter) limit(addr net.Addr) (truncate, drop bool) {
+	if _, ok := addr.(*net.UDPAddr); !ok {
+		return false, false
+	}
+	ip := extractClientIP(addr)
+	if !ip.IsValid() || ip.IsLoopback() {
+		return false, false
+	}
+	bits := l.prefixLen
+	if ip.Is6() {
+		bits = rrlIPv6PrefixLen
+	}
+	prefix, _ := ip.Prefix(bits)
+
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[prefix]
+	if !ok {
+		b = &rrlBucket{tokens: l.burst, last: now}
+		l.buckets[prefix] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		b.limited = 0
+		return false, false
+	}
+
+	b.limited++
+	if b.limited%rrlSlip == 1 {
+		metricRRLTruncated.Add(1)
+		return true, false
+	}
+	metricRRLDropped.Add(1)
+	return false, true
+}
+
+// sweep forgets clients whose buckets have refilled, so the map does not
+// grow with every address ever seen. l.mu must be held.
+func (l *responseLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rrlSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for prefix, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, prefix)
+		}
+	}
+}
+
+// rateLimited applies response rate limiting to r, answering it with an
+// empty truncated response or not at all. It reports whether r was handled.
+func (s *DNSServer) rateLimited(w dns.ResponseWriter, r *dns.Msg) bool {
+	if s.rrl == nil {
+		return false
+	}
+	truncate, drop := s.rrl.limit(w.RemoteAddr())
+	switch {
+	case drop:
+		return true
+	case truncate:
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Truncated = true
+		w.WriteMsg(m)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// sentinelTTL keeps monitoring probes of the sentinel names from being
+// answered out of a resolver cache.
+const sentinelTTL = 1
+
+// handleSentinel answers the names monitoring tools probe to check the proxy
+// is answering: _probe.<domain> resolves to loopback, and _probe._udp.<domain>
+// SRV points at the proxy's DNS port. It reports whether q was one of them.
+func (s *DNSServer) handleSentinel(q dns.Question, m *dns.Msg) bool {
+	for _, d := range s.domains {
+		switch {
+		case strings.EqualFold(q.Name, "_probe."+dns.Fqdn(d)):
+			s.addSentinelAddress(q, m)
+			return true
+		case strings.EqualFold(q.Name, "_probe._udp."+dns.Fqdn(d)):
+			s.addSentinelSRV(q, m)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *DNSServer) addSentinelAddress(q dns.Question, m *dns.Msg) {
+	var ip netip.Addr
+	switch q.Qtype {
+	case dns.TypeA:
+		ip = netip.AddrFrom4([4]byte{127, 0, 0, 1})
+	case dns.TypeAAAA:
+		ip = netip.IPv6Loopback()
+	default:
+		return
+	}
+	m.Answer = append(m.Answer, createRR(q.Name, ip, sentinelTTL))
+}
+
+func (s *DNSServer) addSentinelSRV(q dns.Question, m *dns.Msg) {
+	self := s.status.Load().Self
+	if q.Qtype != dns.TypeSRV || self == nil || self.DNSName == "" {
+		return
+	}
+	port := 53
+	if _, p, err := net.SplitHostPort(*listen); err == nil {
+		port, _ = strconv.Atoi(p)
+	}
+
+	target := dns.Fqdn(self.DNSName)
+	m.Answer = append(m.Answer, &dns.SRV{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeSRV,
+			Class:  dns.ClassINET,
+			Ttl:    sentinelTTL,
+		},
+		Port:   uint16(port),
+		Target: target,
+	})
+	for _, addr := range self.TailscaleIPs {
+		if rr := createRR(target, addr, sentinelTTL); rr != nil {
+			m.Extra = append(m.Extra, rr)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"math/rand/v2"
+
+	"github.com/miekg/dns"
+)
+
+// shuffleAnswers randomizes the order of the address records in answers,
+// the answers to one question, so clients that always use the first address
+// spread their load. Other records, such as a CNAME leading to the
+// addresses, keep their place.
+func shuffleAnswers(answers []dns.RR) {
+	var idx []int
+	for i, rr := range answers {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			idx = append(idx, i)
+		}
+	}
+	// The global source is safe for concurrent use and randomly seeded
+	rand.Shuffle(len(idx), func(i, j int) {
+		answers[idx[i]], answers[idx[j]] = answers[idx[j]], answers[idx[i]]
+	})
+}
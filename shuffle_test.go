@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestShuffleAnswers(t *testing.T) {
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "www.tail1.ts.net.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET},
+		Target: "web.tail1.ts.net.",
+	}
+	answers := []dns.RR{cname}
+	for _, ip := range []string{"100.64.0.2", "100.64.0.3", "100.64.0.4", "fd7a:115c:a1e0::2"} {
+		answers = append(answers, createRR("web.tail1.ts.net.", netip.MustParseAddr(ip), 60))
+	}
+
+	orders := make(map[string]bool)
+	for range 100 {
+		shuffled := append([]dns.RR(nil), answers...)
+		shuffleAnswers(shuffled)
+		if shuffled[0] != cname {
+			t.Fatalf("CNAME moved: %v", shuffled)
+		}
+		var order []string
+		for _, rr := range shuffled {
+			order = append(order, rr.String())
+		}
+		orders[strings.Join(order, "\n")] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("100 shuffles gave %d ordering, want several", len(orders))
+	}
+	for order := range orders {
+		for _, rr := range answers {
+			if !strings.Contains(order, rr.String()) {
+				t.Errorf("shuffled answers lost %s", rr)
+			}
+		}
+	}
+}
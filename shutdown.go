@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// drainTimeout bounds how long shutdown waits for in-flight queries before
+// answering them SERVFAIL and closing the tailnet connection under them. It
+// is a variable so tests can shorten it.
+var drainTimeout = 5 * time.Second
+
+// trackServer records a DNS server so Shutdown can stop it.
+func (s *DNSServer) trackServer(server *dns.Server) {
+	s.serversMu.Lock()
+	defer s.serversMu.Unlock()
+	s.servers = append(s.servers, server)
+}
+
+// serveUntilError waits for the first server to fail and exits, unless the
+// failure is the listener closing for Shutdown, in which case it blocks
+// while the shutdown completes.
+func (s *DNSServer) serveUntilError(errc <-chan error) {
+	err := <-errc
+	if !s.shuttingDown.Load() {
+		log.Fatal(err)
+	}
+	select {}
+}
+
+// Shutdown stops accepting queries and waits up to drainTimeout for those
+// in flight to finish, so they are not cut off when the tailnet connection
+// closes. Queries still running after the deadline are answered SERVFAIL
+// before it returns, and their handlers' own answers are dropped.
+func (s *DNSServer) Shutdown() {
+	s.shuttingDown.Store(true)
+
+	s.serversMu.Lock()
+	servers := s.servers
+	s.serversMu.Unlock()
+
+	// Stopping a server stops it accepting at once, but only closes its
+	// socket once its handlers return or its context ends. Stop them in the
+	// background so the drain has its own deadline, and end their contexts
+	// only after the drain, as queries answered SERVFAIL need the socket.
+	stopCtx, stop := context.WithCancel(context.Background())
+	var stopped sync.WaitGroup
+	for _, server := range servers {
+		stopped.Add(1)
+		go func() {
+			defer stopped.Done()
+			if err := server.ShutdownContext(stopCtx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("Error stopping DNS server: %v", err)
+			}
+		}()
+	}
+	defer stopped.Wait()
+	defer stop()
+
+	if s.inflight.wait(drainTimeout) {
+		log.Printf("All in-flight queries finished")
+		return
+	}
+	n := s.inflight.abort()
+	log.Printf("Timed out after %v waiting for in-flight queries, answered %d SERVFAIL", drainTimeout, n)
+}
+
+// inflightQueries tracks the queries being handled, so Shutdown can wait
+// for them and answer those that outlive the drain.
+type inflightQueries struct {
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	writers map[*drainWriter]bool
+}
+
+// start records a query arriving on w and returns the writer its handler
+// must answer through.
+func (q *inflightQueries) start(w dns.ResponseWriter, r *dns.Msg) *drainWriter {
+	dw := &drainWriter{ResponseWriter: w, req: r}
+	q.wg.Add(1)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.writers == nil {
+		q.writers = make(map[*drainWriter]bool)
+	}
+	q.writers[dw] = true
+	return dw
+}
+
+// finish records that the handler for dw has returned.
+func (q *inflightQueries) finish(dw *drainWriter) {
+	q.mu.Lock()
+	delete(q.writers, dw)
+	q.mu.Unlock()
+	q.wg.Done()
+}
+
+// wait reports whether every query finished within timeout.
+func (q *inflightQueries) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// abort answers every query still in flight SERVFAIL, unless its handler
+// has already started answering, and returns how many it answered.
+func (q *inflightQueries) abort() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for dw := range q.writers {
+		if dw.abort() {
+			n++
+		}
+	}
+	return n
+}
+
+// drainWriter passes a handler's answer through until Shutdown aborts the
+// query, then drops it: the tailnet connection may have closed under the
+// handler, so its answer can't be trusted.
+type drainWriter struct {
+	dns.ResponseWriter
+	req *dns.Msg
+
+	mu      sync.Mutex
+	written bool
+	aborted bool
+}
+
+func (w *drainWriter) WriteMsg(m *dns.Msg) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// Dropped answers are not errors to the handler, which could otherwise
+	// stall partway through a zone transfer
+	if w.aborted {
+		return nil
+	}
+	w.written = true
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func (w *drainWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.aborted {
+		return len(b), nil
+	}
+	w.written = true
+	return w.ResponseWriter.Write(b)
+}
+
+// abort answers the query SERVFAIL if nothing has been written for it yet,
+// reporting whether it did, and drops whatever the handler writes later.
+func (w *drainWriter) abort() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.aborted {
+		return false
+	}
+	w.aborted = true
+	if w.written {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetRcode(w.req, dns.RcodeServerFailure)
+	if w.req.IsEdns0() != nil {
+		addExtendedError(m, dns.ExtendedErrorCodeOther, "server is shutting down")
+	}
+	if err := w.ResponseWriter.WriteMsg(m); err != nil {
+		log.Printf("Error answering in-flight query from %s: %v", w.RemoteAddr(), err)
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestShutdownAnswersSlowQueries(t *testing.T) {
+	s := newStaticTestServer(t)
+	s.latency = &latencyInjector{delay: time.Second, rate: 1}
+	old := drainTimeout
+	drainTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { drainTimeout = old })
+
+	r := new(dns.Msg)
+	r.SetQuestion("web.tail1.ts.net.", dns.TypeA)
+	r.SetEdns0(ednsUDPSize, false)
+	w := &captureWriter{}
+	done := make(chan struct{})
+	go func() {
+		s.handleDNSRequest(w, r)
+		close(done)
+	}()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		s.inflight.mu.Lock()
+		n := len(s.inflight.writers)
+		s.inflight.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("query never started")
+		}
+	}
+
+	// The handler is held past the drain deadline, so Shutdown answers
+	// for it, and its own answer is dropped when it finishes
+	s.Shutdown()
+	check := func(when string) {
+		t.Helper()
+		if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure || len(w.msg.Answer) != 0 {
+			t.Fatalf("%s: response = %v, want SERVFAIL with no answers", when, w.msg)
+		}
+		opt := w.msg.IsEdns0()
+		if opt == nil || len(opt.Option) != 1 {
+			t.Fatalf("%s: response has no Extended DNS Error: %v", when, w.msg)
+		}
+		if ede, ok := opt.Option[0].(*dns.EDNS0_EDE); !ok || ede.ExtraText != "server is shutting down" {
+			t.Errorf("%s: option = %v, want the shutdown Extended DNS Error", when, opt.Option[0])
+		}
+	}
+	check("after Shutdown")
+	<-done
+	check("after the handler finished")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// querySlots bounds the queries handled at once, so a flood of queries,
+// each of which may call into tailscaled, cannot exhaust memory. Queries
+// wait up to timeout for a slot to free up.
+type querySlots struct {
+	sem     chan struct{}
+	timeout time.Duration
+}
+
+func newQuerySlots(size int, timeout time.Duration) *querySlots {
+	return &querySlots{sem: make(chan struct{}, size), timeout: timeout}
+}
+
+// acquire takes a slot, waiting up to the timeout, and reports whether it
+// got one. Every successful acquire must be followed by a release.
+func (q *querySlots) acquire() bool {
+	select {
+	case q.sem <- struct{}{}:
+	default:
+		timer := time.NewTimer(q.timeout)
+		defer timer.Stop()
+		select {
+		case q.sem <- struct{}{}:
+		case <-timer.C:
+			metricRejectedQueries.Add(1)
+			return false
+		}
+	}
+	metricQueuedQueries.Add(1)
+	return true
+}
+
+func (q *querySlots) release() {
+	<-q.sem
+	metricQueuedQueries.Add(-1)
+}
+
+// overloaded takes a query slot for r, answering it SERVFAIL if none
+// frees up in time. It reports whether r was answered; otherwise the
+// caller must release the slot once done.
+func (s *DNSServer) overloaded(w dns.ResponseWriter, r *dns.Msg) bool {
+	if s.slots == nil || s.slots.acquire() {
+		return false
+	}
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeServerFailure)
+	addExtendedError(m, dns.ExtendedErrorCodeOther, "too many queries in flight")
+	w.WriteMsg(m)
+	return true
+}
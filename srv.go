@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// handleSRVQuery answers _http._tcp.<name> and _https._tcp.<name> with
+// one record per port the peer serves HTTP or HTTPS on. This node's ports
+// come from its live Tailscale Serve configuration; other peers' come from
+// -peer-serve-config-file, since their serve configs are not visible here.
+func (s *DNSServer) handleSRVQuery(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	service, name, ok := strings.Cut(strings.TrimSuffix(strings.ToLower(q.Name), "."), "._tcp.")
+	if !ok || (service != "_http" && service != "_https") {
+		return
+	}
+
+	status, err := s.fetchStatus()
+	if err != nil {
+		qlog.Error("Error getting status", "err", err)
+		return
+	}
+	var sc *ipn.ServeConfig
+	var target string
+	if s.isSelf(status, name) {
+		sc, err = s.serveConfig()
+		if err != nil {
+			qlog.Error("Error getting serve config", "err", err)
+			return
+		}
+		target = status.Self.DNSName
+	} else if peer := s.findPeer(status, name, qlog); peer != nil {
+		sc = s.peerServe.lookup(peer.DNSName)
+		target = peer.DNSName
+	}
+	if sc == nil {
+		qlog.Info("No serve config known", "name", name)
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+
+	ports := servePorts(sc, service == "_https")
+	if len(ports) == 0 {
+		qlog.Info("Peer is not serving the service", "name", name, "service", service)
+		m.Rcode = dns.RcodeNameError
+		return
+	}
+	for _, port := range ports {
+		m.Answer = append(m.Answer, &dns.SRV{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeSRV,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(*ttl),
+			},
+			Port:   port,
+			Target: dns.Fqdn(target),
+		})
+	}
+}
+
+// servePorts returns the sorted TCP ports sc serves HTTPS on, or plain HTTP
+// if https is false, including those of foreground "tailscale serve"
+// sessions.
+func servePorts(sc *ipn.ServeConfig, https bool) []uint16 {
+	seen := make(map[uint16]bool)
+	var ports []uint16
+	configs := []*ipn.ServeConfig{sc}
+	for _, fg := range sc.Foreground {
+		configs = append(configs, fg)
+	}
+	for _, c := range configs {
+		for port, h := range c.TCP {
+			if h == nil || seen[port] || (https && !h.HTTPS) || (!https && !h.HTTP) {
+				continue
+			}
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+// peerServeConfigs maps a lowercase peer name, full or base, to the Serve
+// configuration it published with "tailscale serve status --json".
+type peerServeConfigs map[string]*ipn.ServeConfig
+
+// loadPeerServeConfigs reads a JSON object mapping peer names to their
+// "tailscale serve status --json" output.
+func loadPeerServeConfigs(path string) (peerServeConfigs, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]*ipn.ServeConfig
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	configs := make(peerServeConfigs, len(raw))
+	for peer, sc := range raw {
+		if sc != nil {
+			configs[strings.ToLower(strings.TrimSuffix(peer, "."))] = sc
+		}
+	}
+	return configs, nil
+}
+
+// lookup returns the serve config for the peer with full DNS name name,
+// matching entries by full or base name.
+func (p peerServeConfigs) lookup(name string) *ipn.ServeConfig {
+	name = strings.ToLower(dnsname.TrimSuffix(name, "."))
+	if sc, ok := p[name]; ok {
+		return sc
+	}
+	return p[dnsname.FirstLabel(name)]
+}
+
+// handleHTTPSQuery answers an HTTPS (SVCB) query for this node with an
+// HTTPS-first hint when Tailscale Serve is serving HTTPS on port 443
+// (RFC 9460).
+func (s *DNSServer) handleHTTPSQuery(q dns.Question, m *dns.Msg) {
+	status, err := s.fetchStatus()
+	if err != nil {
+		log.Printf("Error getting status: %v", err)
+		return
+	}
+	if !s.isSelf(status, dnsname.TrimSuffix(strings.ToLower(q.Name), ".")) {
+		return
+	}
+	sc, err := s.serveConfig()
+	if err != nil {
+		log.Printf("Error getting serve config: %v", err)
+		return
+	}
+	if !sc.IsServingHTTPS(443) {
+		return
+	}
+
+	m.Answer = append(m.Answer, &dns.HTTPS{SVCB: dns.SVCB{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeHTTPS,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(*ttl),
+		},
+		Priority: 1,
+		Target:   ".",
+		Value: []dns.SVCBKeyValue{
+			&dns.SVCBAlpn{Alpn: []string{"h2", "http/1.1"}},
+			&dns.SVCBPort{Port: 443},
+		},
+	}})
+}
+
+// isSelf reports whether name, without trailing dot, is this node's full
+// or base name.
+func (s *DNSServer) isSelf(status *ipnstate.Status, name string) bool {
+	self := strings.ToLower(dnsname.TrimSuffix(status.Self.DNSName, "."))
+	return name == self || s.trimDomain(name) == dnsname.FirstLabel(self)
+}
+
+// serveConfig fetches this node's Tailscale Serve configuration, which
+// -static-peers-file has none of.
+func (s *DNSServer) serveConfig() (*ipn.ServeConfig, error) {
+	if s.tsnet == nil {
+		return nil, errors.New("no tailnet connection with -static-peers-file")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lc, err := s.tsnet.LocalClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting local client: %w", err)
+	}
+	return lc.GetServeConfig(ctx)
+}
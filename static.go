@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// staticPeersReloadInterval is how often -static-peers-file is re-read.
+const staticPeersReloadInterval = 30 * time.Second
+
+// loadStaticStatus reads a tailnet status saved with "tailscale status
+// --json".
+func loadStaticStatus(path string) (*ipnstate.Status, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	status := new(ipnstate.Status)
+	if err := json.Unmarshal(data, status); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if status.Self == nil {
+		return nil, fmt.Errorf("%s has no Self node", path)
+	}
+	return status, nil
+}
+
+// staticStatus returns the status last loaded from -static-peers-file, in
+// place of asking tailscaled.
+func (s *DNSServer) staticStatus() (*ipnstate.Status, error) {
+	status := s.status.Load()
+	if status == nil {
+		return nil, errors.New("static peers not loaded yet")
+	}
+	return status, nil
+}
+
+// reloadStaticPeers re-reads -static-peers-file until the process exits,
+// keeping the last good status if the file becomes unreadable.
+func (s *DNSServer) reloadStaticPeers(path string) {
+	for range time.Tick(staticPeersReloadInterval) {
+		status, err := loadStaticStatus(path)
+		if err != nil {
+			log.Printf("Error reloading static peers: %v", err)
+			continue
+		}
+		s.status.Store(status)
+		s.updates.publish()
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newStaticTestServer returns a server answering from testdata/status.json
+// as it would with -static-peers-file.
+func newStaticTestServer(t testing.TB) *DNSServer {
+	t.Helper()
+	const path = "testdata/status.json"
+	status, err := loadStaticStatus(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &DNSServer{
+		staticPeers: path,
+		minimal:     true,
+		ipType:      "both",
+		ipSelect:    "all",
+		shortNames:  "pick",
+		outOfZone:   policyRefused,
+	}
+	s.SetStatus(status, []string{"tail1.ts.net"})
+	return s
+}
+
+// query runs a single question through the request handler and returns
+// the response.
+func query(t *testing.T, s *DNSServer, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	r := new(dns.Msg)
+	r.SetQuestion(name, qtype)
+	w := &captureWriter{}
+	s.handleDNSRequest(w, r)
+	if w.msg == nil {
+		t.Fatalf("%s %s: no response", name, dns.TypeToString[qtype])
+	}
+	return w.msg
+}
+
+func TestStaticPeersResolution(t *testing.T) {
+	s := newStaticTestServer(t)
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+		want  []string
+	}{
+		{"web.tail1.ts.net.", dns.TypeA, dns.RcodeSuccess, []string{"100.64.0.2"}},
+		{"web.tail1.ts.net.", dns.TypeAAAA, dns.RcodeSuccess, []string{"fd7a:115c:a1e0::2"}},
+		{"WEB.Tail1.TS.net.", dns.TypeA, dns.RcodeSuccess, []string{"100.64.0.2"}},
+		{"proxy.tail1.ts.net.", dns.TypeA, dns.RcodeSuccess, []string{"100.64.0.1"}},
+		{"db.tail1.ts.net.", dns.TypeA, dns.RcodeSuccess, []string{"100.64.0.3"}},
+		{"2.0.64.100.in-addr.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"web.tail1.ts.net."}},
+		{"3.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", dns.TypePTR, dns.RcodeSuccess, nil},
+		{"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", dns.TypePTR, dns.RcodeSuccess, []string{"web.tail1.ts.net."}},
+		{"missing.tail1.ts.net.", dns.TypeA, dns.RcodeSuccess, nil},
+		{"example.com.", dns.TypeA, dns.RcodeRefused, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+dns.TypeToString[tt.qtype], func(t *testing.T) {
+			m := query(t, s, tt.name, tt.qtype)
+			if m.Rcode != tt.rcode {
+				t.Fatalf("rcode = %s, want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			var got []string
+			for _, rr := range m.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				case *dns.PTR:
+					got = append(got, rr.Ptr)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("answers = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("answer %d = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/metrics"
+)
+
+// statsdSampleSize is the most observations of a histogram sent to StatsD
+// per flush. Beyond it, a random sample is sent with its sample rate, so
+// StatsD still counts every observation.
+const statsdSampleSize = 100
+
+// statsdEnabled is set once metrics are published to StatsD, before which
+// histograms keep no observations.
+var statsdEnabled atomic.Bool
+
+// timingHistograms are the histograms sent to StatsD, by expvar name.
+var timingHistograms = make(map[string]*timingHistogram)
+
+// timingHistogram is a histogram of durations in seconds that also keeps a
+// sample of its observations since the last StatsD flush, which StatsD
+// receives as timings.
+type timingHistogram struct {
+	*metrics.Histogram
+
+	mu     sync.Mutex
+	seen   int
+	sample []float64
+}
+
+func newTimingHistogram(buckets []float64) *timingHistogram {
+	return &timingHistogram{Histogram: metrics.NewHistogram(buckets)}
+}
+
+// publishHistogram publishes h as the expvar name, which varz exports as a
+// Prometheus histogram, and registers it for StatsD.
+func publishHistogram(name string, h *timingHistogram) {
+	expvar.Publish(name, h.Histogram)
+	timingHistograms[name] = h
+}
+
+// Observe records an observation of v seconds.
+func (h *timingHistogram) Observe(v float64) {
+	h.Histogram.Observe(v)
+	if !statsdEnabled.Load() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// Reservoir sampling keeps each observation with equal probability
+	h.seen++
+	if len(h.sample) < statsdSampleSize {
+		h.sample = append(h.sample, v)
+	} else if i := rand.IntN(h.seen); i < statsdSampleSize {
+		h.sample[i] = v
+	}
+}
+
+// take returns the sampled observations and how many there were in all,
+// and starts a new sample.
+func (h *timingHistogram) take() (sample []float64, seen int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sample, seen = h.sample, h.seen
+	h.sample, h.seen = nil, 0
+	return sample, seen
+}
+
+// statsdPublisher periodically sends the expvar metrics to a StatsD server,
+// as counts for counter_ metrics, gauges for gauge_ metrics and timings in
+// milliseconds for histogram_ metrics.
+type statsdPublisher struct {
+	conn   net.Conn
+	prefix string
+	last   map[string]int64 // counter values at the previous flush
+}
+
+// runStatsD publishes metrics to the StatsD server at addr every interval.
+// It runs independently of the Prometheus handler, which reads the same
+// expvars.
+func runStatsD(addr, prefix string, interval time.Duration) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Printf("Error connecting to StatsD at %s: %v", addr, err)
+		return
+	}
+	p := &statsdPublisher{conn: conn, prefix: prefix, last: make(map[string]int64)}
+	statsdEnabled.Store(true)
+	log.Printf("Publishing StatsD metrics to %s every %v", addr, interval)
+	for range time.Tick(interval) {
+		p.flush()
+	}
+}
+
+// flush sends one datagram per metric. Counters are sent as the increase
+// since the previous flush, and histograms as the observations made since
+// then, named without their _seconds suffix.
+func (p *statsdPublisher) flush() {
+	expvar.Do(func(kv expvar.KeyValue) {
+		var kind, base string
+		if name, ok := strings.CutPrefix(kv.Key, "counter_"); ok {
+			kind, base = "c", name
+		} else if name, ok := strings.CutPrefix(kv.Key, "gauge_"); ok {
+			kind, base = "g", name
+		} else {
+			return
+		}
+		base = p.prefix + strings.TrimPrefix(base, "tsmagicproxy_")
+
+		switch v := kv.Value.(type) {
+		case *metrics.LabelMap:
+			v.Do(func(lkv expvar.KeyValue) {
+				p.send(base+"."+statsdName(lkv.Key), kind, lkv.Value)
+			})
+		default:
+			p.send(base, kind, v)
+		}
+	})
+
+	names := make([]string, 0, len(timingHistograms))
+	for name := range timingHistograms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sample, seen := timingHistograms[name].take()
+		base := strings.TrimPrefix(strings.TrimPrefix(name, "histogram_"), "tsmagicproxy_")
+		base = p.prefix + strings.TrimSuffix(base, "_seconds")
+		for _, v := range sample {
+			p.sendTiming(base, v*1000, float64(len(sample))/float64(seen))
+		}
+	}
+}
+
+// send writes a single metric, skipping values that are not integers.
+func (p *statsdPublisher) send(name, kind string, v expvar.Var) {
+	n, err := strconv.ParseInt(v.String(), 10, 64)
+	if err != nil {
+		return
+	}
+	if kind == "c" {
+		n, p.last[name] = n-p.last[name], n
+		if n == 0 {
+			return
+		}
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:%d|%s", name, n, kind)
+	if _, err := p.conn.Write(b.Bytes()); err != nil {
+		log.Printf("Error sending StatsD metric %s: %v", name, err)
+	}
+}
+
+// sendTiming writes a single timing of ms milliseconds, sampled at rate.
+func (p *statsdPublisher) sendTiming(name string, ms, rate float64) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:%s|ms", name, strconv.FormatFloat(ms, 'f', -1, 64))
+	if rate < 1 {
+		fmt.Fprintf(&b, "|@%s", strconv.FormatFloat(rate, 'f', -1, 64))
+	}
+	if _, err := p.conn.Write(b.Bytes()); err != nil {
+		log.Printf("Error sending StatsD metric %s: %v", name, err)
+	}
+}
+
+// statsdName makes a label value safe to use as a StatsD name component.
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', ' ':
+			return '_'
+		}
+		return r
+	}, strings.TrimSuffix(s, "."))
+}
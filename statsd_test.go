@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flushTimings flushes p and returns the timings it sent for name.
+func flushTimings(t *testing.T, p *statsdPublisher, server net.PacketConn, name string) []string {
+	t.Helper()
+	p.flush()
+	var got []string
+	buf := make([]byte, 512)
+	for {
+		server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			return got
+		}
+		if line := string(buf[:n]); strings.HasPrefix(line, name+":") {
+			got = append(got, line)
+		}
+	}
+}
+
+func TestStatsDTimings(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	p := &statsdPublisher{conn: conn, prefix: "tsmagicproxy.", last: make(map[string]int64)}
+
+	statsdEnabled.Store(true)
+	t.Cleanup(func() { statsdEnabled.Store(false) })
+	h := metricPeerUpdateLatency
+	h.take()
+	const name = "tsmagicproxy.peer_update_latency"
+
+	h.Observe(.005)
+	h.Observe(.25)
+	got := flushTimings(t, p, server, name)
+	slices.Sort(got)
+	want := []string{name + ":250|ms", name + ":5|ms"}
+	if !slices.Equal(got, want) {
+		t.Errorf("timings = %q, want %q", got, want)
+	}
+
+	// Past the sample size, a sample is sent at its rate
+	for range 250 {
+		h.Observe(.01)
+	}
+	got = flushTimings(t, p, server, name)
+	if len(got) != statsdSampleSize {
+		t.Fatalf("sent %d timings, want %d", len(got), statsdSampleSize)
+	}
+	for _, line := range got {
+		if line != name+":10|ms|@0.4" {
+			t.Fatalf("timing = %q, want %q", line, name+":10|ms|@0.4")
+		}
+	}
+
+	if got := flushTimings(t, p, server, name); len(got) != 0 {
+		t.Errorf("flush with no new observations sent %q", got)
+	}
+}
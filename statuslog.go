@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// logStatusSummaries logs a summary of the peer list every interval, from
+// the cached status so the refresh cadence is not disturbed, to give a
+// baseline of the tailnet's size and show peers that stop coming back.
+func (s *DNSServer) logStatusSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		status := s.status.Load()
+		if status == nil {
+			continue
+		}
+		var online, direct, relay int
+		for _, peer := range status.Peer {
+			if !peer.Online {
+				continue
+			}
+			online++
+			// Peers without a direct path are reached over DERP
+			switch {
+			case peer.CurAddr != "":
+				direct++
+			case peer.Relay != "":
+				relay++
+			}
+		}
+		slog.Info("peer status summary",
+			"total_peers", len(status.Peer),
+			"online", online,
+			"offline", len(status.Peer)-online,
+			"direct", direct,
+			"relay", relay,
+			"zone", s.domain)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/views"
+	"tailscale.com/util/dnsname"
+)
+
+// tagZones maps a lowercase FQDN zone to the ACL tag whose peers it holds,
+// as set by -tag-zones: with tag:web-prod=prod.internal, web.prod.internal
+// resolves to the peer named web that carries tag:web-prod.
+type tagZones map[string]string
+
+// parseTagZones parses the -tag-zones flag, a comma-separated list of
+// tag=zone pairs.
+func parseTagZones(s string) (tagZones, error) {
+	zones := tagZones{}
+	for _, pair := range splitList(s) {
+		tag, zone, ok := strings.Cut(pair, "=")
+		tag, zone = strings.TrimSpace(tag), strings.ToLower(strings.TrimSpace(zone))
+		if !ok || !strings.HasPrefix(tag, "tag:") || len(tag) == len("tag:") || zone == "" {
+			return nil, fmt.Errorf("%q is not of the form tag:name=zone", pair)
+		}
+		zone = dns.Fqdn(zone)
+		if _, ok := dns.IsDomainName(zone); !ok {
+			return nil, fmt.Errorf("%q is not a valid zone name", zone)
+		}
+		if other, dup := zones[zone]; dup {
+			return nil, fmt.Errorf("zone %q is given for both %s and %s", zone, other, tag)
+		}
+		zones[zone] = tag
+	}
+	return zones, nil
+}
+
+// mustParseTagZones is like parseTagZones but for a flag that has already
+// passed validateConfig.
+func mustParseTagZones(s string) tagZones {
+	zones, err := parseTagZones(s)
+	if err != nil {
+		panic(err)
+	}
+	return zones
+}
+
+// match returns the most specific tag zone that name lies directly under,
+// with the label before it and the zone's tag.
+func (z tagZones) match(name string) (label, tag string, ok bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	var owner string
+	for zone, t := range z {
+		if len(zone) > len(owner) && dns.IsSubDomain(zone, name) && dns.CountLabel(name) == dns.CountLabel(zone)+1 {
+			owner, tag = zone, t
+		}
+	}
+	if owner == "" {
+		return "", "", false
+	}
+	return dnsname.FirstLabel(name), tag, true
+}
+
+// taggedPeers returns the peers qname matches through -tag-zones: those
+// whose base name is the label before the zone and that carry the zone's
+// tag.
+func (s *DNSServer) taggedPeers(status *ipnstate.Status, qname string) []*ipnstate.PeerStatus {
+	label, tag, ok := s.tagZones.match(qname)
+	if !ok {
+		return nil
+	}
+	var peers []*ipnstate.PeerStatus
+	for _, peer := range peersAndSelf(status) {
+		if peer.DNSName != "" && peer.Tags != nil && strings.EqualFold(dnsname.FirstLabel(peer.DNSName), label) &&
+			views.SliceContains(*peer.Tags, tag) {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
+
+// findTaggedPeer returns the peer qname matches through -tag-zones, or nil.
+func (s *DNSServer) findTaggedPeer(status *ipnstate.Status, qname string, qlog *slog.Logger) *ipnstate.PeerStatus {
+	peers := s.taggedPeers(status, qname)
+	switch len(peers) {
+	case 0:
+		return nil
+	case 1:
+		qlog.Info("Found tag zone match", "name", qname, "peer", peers[0].DNSName)
+		return peers[0]
+	}
+	return s.breakTie(qname, peers, qlog)
+}
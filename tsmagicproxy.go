@@ -3,78 +3,357 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"log"
+	"log/slog"
+	"maps"
 	"net"
+	"net/http"
 	"net/netip"
 	"os"
+	"os/signal"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/miekg/dns"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tsnet"
 	"tailscale.com/util/dnsname"
 )
 
 var (
-	authKey     = flag.String("authkey", os.Getenv("TS_AUTHKEY"), "Tailscale auth key")
-	hostname    = flag.String("hostname", "tsmagicproxy", "Hostname for the tailnet node")
-	stateDir    = flag.String("state-dir", "./tsmagicproxy-state", "Directory to store tailscale state")
-	listen      = flag.String("listen", ":53", "Address to listen on for DNS requests")
-	ttl         = flag.Int("ttl", 600, "TTL for DNS responses")
-	domain      = flag.String("domain", "", "Domain suffix to append to hostnames (e.g., tailnet.ts.net)")
-	forceLogin  = flag.Bool("force-login", false, "Force login even if state exists")
-	debug       = flag.Bool("debug", false, "Enable verbose debug logging")
+	authKey    = flag.String("authkey", os.Getenv("TS_AUTHKEY"), "Tailscale auth key")
+	hostname   = flag.String("hostname", "tsmagicproxy", "Hostname for the tailnet node")
+	stateDir   = flag.String("state-dir", "./tsmagicproxy-state", "Directory to store tailscale state")
+	listen     = flag.String("listen", ":53", "Address to listen on for DNS requests")
+	listen4    = flag.String("listen-ipv4", "", "IPv4 address to listen on for DNS requests on a dedicated socket (e.g., 0.0.0.0:53)")
+	listen6    = flag.String("listen-ipv6", "", "IPv6 address to listen on for DNS requests on a dedicated IPv6-only socket (e.g., [::]:53)")
+	ttl        = flag.Int("ttl", 600, "TTL for DNS responses")
+	domain     = flag.String("domain", "", "Domain suffix to append to hostnames (e.g., tailnet.ts.net)")
+	domains    = flag.String("domains", "", "Additional comma-separated domain suffixes to accept in queries (e.g., mycompany.ts.net)")
+	forceLogin = flag.Bool("force-login", false, "Force login even if state exists")
+	debug      = flag.Bool("debug", false, "Enable verbose debug logging")
+	logFormat  = flag.String("log-format", "text", "Log output format: text or json")
+
+	authKeyURL       = flag.String("authkey-refresh-url", "", "URL that returns a new auth key on GET, used to log in again when this node's key expires (disabled if empty)")
+	keyExpiryAlert   = flag.Int("key-expiry-alert-interval", 3600, "Seconds between alerts logged while this node's key is expired and it has not been re-authenticated")
+	tailscaleOnly    = flag.Bool("tailscale-only", false, "Serve DNS only on this node's Tailscale IPs, at the port of -listen, instead of on host interfaces")
+	unixSocket       = flag.String("unix-socket", "", "Path of a Unix stream socket to also serve DNS on, with a datagram socket at the path plus .dgram, e.g. for sidecar containers (disabled if empty)")
+	unixSocketMode   = flag.String("unix-socket-mode", "0660", "Octal file mode of the -unix-socket sockets")
+	sharedDomain     = flag.String("shared-peer-domain", "", "Zone for peers shared from other tailnets; machine.other-tailnet.ts.net resolves as machine.<zone> (e.g., shared.internal)")
+	passthrough      = flag.Bool("magicdns-passthrough", false, "Resolve names in the tailnet domain with tailscaled's MagicDNS resolver instead of matching peers, keeping local overrides such as -dname and -weighted-record")
+	upstream         = flag.String("upstream", "", "Comma-separated upstream DNS servers (host[:port], tls://host[:port][#server-name] for DNS over TLS, or an https:// URL for DNS over HTTPS) for queries outside the tailnet zones")
+	upstreamTLS      = flag.Bool("upstream-tls", false, "Forward to every -upstream over DNS over TLS; single upstreams can use it as tls://host[:port][#server-name]")
+	upstreamInsecure = flag.Bool("upstream-tls-skip-verify", false, "Do not verify DNS-over-TLS and DNS-over-HTTPS upstream certificates, e.g. for private resolvers with self-signed certificates")
+	dohTimeout       = flag.Int("upstream-http-timeout", 5, "Seconds before a query to a DNS-over-HTTPS (https://) upstream fails")
+	outOfZone        = flag.String("out-of-zone", "", "Response to queries outside the tailnet zones: refused, nxdomain, servfail or forward (default: forward if -upstream is set, else refused)")
+	qnameMinimize    = flag.Bool("qname-minimize", false, "Resolve forwarded queries iteratively from the upstreams (e.g., root servers) with QNAME minimization")
+	stripECS         = flag.Bool("strip-ecs", true, "Zero the EDNS Client Subnet option in forwarded queries to hide client addresses")
+	responseMinimize = flag.Bool("response-minimize", true, "Strip authority and additional records a response does not need, including glue from upstreams; only a negative response's SOA and records for answer targets are kept")
+	probePeers       = flag.Bool("probe-peers", false, "Only answer with peers that recently accepted a TCP connection on -probe-port")
+	probePort        = flag.Int("probe-port", 0, "TCP port dialed on each peer by -probe-peers, which requires it")
+	probeTTL         = flag.Int("probe-ttl", 60, "Seconds a successful peer probe stays valid")
+	healthInterval   = flag.Int("health-check-interval", 10, "Seconds between -health-check requests")
+	healthTimeout    = flag.Int("health-check-timeout", 5, "Seconds before a -health-check request fails")
+	healthThreshold  = flag.Int("health-check-threshold", 3, "Consecutive -health-check failures before a peer is left out of answers")
+	ipType           = flag.String("ip-type", "both", "Address types answered for peers: ipv4 (A only), ipv6 (AAAA only) or both; other queries get NODATA")
+	ipSelect         = flag.String("ip-select", "all", "Addresses of the queried type answered for peers with several: all, first, last or random (one chosen at random), for clients that handle several poorly")
+	shortNameMode    = flag.String("short-name-conflicts", "pick", "What to answer when a base name matches several peers: pick (one chosen deterministically) or servfail")
+	excludeIPs       = flag.String("exclude-ips", "", "Comma-separated CIDR prefixes whose addresses are never returned in answers")
+	includeOnlyIPs   = flag.String("include-only-ips", "", "Comma-separated CIDR prefixes; if set, only addresses within them are returned in answers")
+	departedGrace    = flag.Int("departed-grace", 0, "Seconds to answer NXDOMAIN for peers that left the tailnet, such as disconnected ephemeral nodes (0 disables)")
+	webhookEvents    = flag.String("webhook-events", "peer_joined,peer_left,peer_ip_changed", "Comma-separated peer lifecycle events sent to -webhook-url: peer_joined, peer_left and peer_ip_changed")
+	webhookTimeout   = flag.Int("webhook-timeout", 10, "Seconds before a -webhook-url delivery attempt fails")
+	exposeConfigDNS  = flag.Bool("expose-config-dns", false, "Answer TXT queries for _config.<domain> with version, domain, uptime and peer count")
+	autoSRV          = flag.Bool("auto-srv", false, "Answer _http._tcp and _https._tcp SRV queries with the ports peers serve web traffic on")
+	peerServeConfig  = flag.String("peer-serve-config-file", "", "JSON file mapping peer names to their \"tailscale serve status --json\" output, for -auto-srv answers about other peers")
+	autoHTTPSHints   = flag.Bool("auto-https-hints", false, "Answer HTTPS (SVCB) queries for this node with an HTTPS-first hint when Tailscale Serve serves HTTPS on port 443")
+	useNodeAttrs     = flag.Bool("use-node-attributes", false, "Publish TXT and SRV records from peers' dns.tsmagicproxy/txt-<key>=<value> and dns.tsmagicproxy/srv-<service>=<port> node attributes")
+	exposeTagsNAPTR  = flag.Bool("expose-tags-naptr", false, "Answer NAPTR queries for peers with one record per ACL tag, pointing at _<tag>._tcp.<peer>; tags may be sensitive")
+	exitNodeRecords  = flag.Bool("exit-node-records", false, "Answer TXT queries for exit node peers with the public IP of their current WireGuard endpoint, if they are reached directly")
+	rpzFile          = flag.String("rpz-file", "", "Response policy zone file (RFC 1035 format) with QNAME and response-IP firewall rules")
+	rpzURL           = flag.String("rpz-url", "", "URL to fetch the response policy zone from, instead of -rpz-file")
+	rpzRefresh       = flag.Int("rpz-refresh", 3600, "Seconds between reloads of the response policy zone")
+	tagZoneList      = flag.String("tag-zones", "", "Comma-separated tag=zone pairs; name.<zone> resolves to the peer with base name name carrying the tag, to tell apart peers sharing a name (e.g., tag:web-prod=prod.internal)")
+	ownedZones       = flag.String("owned-zones", "", "Comma-separated reverse zones to answer authoritatively, with NXDOMAIN and SOA for unknown names and this node as NS (e.g., 64.100.in-addr.arpa)")
+	axfrAllowFrom    = flag.String("axfr-allow-from", "", "Comma-separated IPs or CIDR prefixes allowed to request zone transfers (AXFR)")
+	ixfrHistory      = flag.Int("ixfr-history-size", 10, "Zone versions kept for incremental zone transfers (IXFR); older serials get a full transfer")
+	notifyAddrs      = flag.String("notify-secondaries", "", "Comma-separated secondary DNS servers (host[:port]) to send NOTIFY to when the peer list changes")
+	zoneFile         = flag.String("zone-file", "", "Path to write the tailnet zone to whenever the peer list changes, for secondaries that load zones from files (disabled if empty)")
+	zoneFileFormat   = flag.String("zone-file-format", "bind", "Format of -zone-file: bind (RFC 1035) or json")
+	rrlRate          = flag.Int("rrl-rate", 50, "Responses per second allowed to each client prefix over UDP before responses are truncated or dropped (0 disables)")
+	rrlWindow        = flag.Int("rrl-window", 1, "Seconds of -rrl-rate responses a client prefix may send in a burst")
+	rrlPrefixLen     = flag.Int("rrl-prefix-len", 24, "IPv4 prefix length clients are grouped by for response rate limiting")
+	maxQueries       = flag.Int("max-concurrent-queries", 100, "Queries handled at once; further queries wait up to -queue-timeout for a slot, then get SERVFAIL (0 disables)")
+	queueTimeout     = flag.Int("queue-timeout", 500, "Milliseconds a query waits for a -max-concurrent-queries slot before it is answered SERVFAIL")
+	nxAlertThreshold = flag.Int("nxdomain-alert-threshold", 50, "NXDOMAIN answers for the same client, name and type within -nxdomain-alert-window above which a warning is logged (0 disables)")
+	nxAlertWindow    = flag.Int("nxdomain-alert-window", 60, "Seconds over which -nxdomain-alert-threshold is counted")
+	statusInterval   = flag.Int("status-log-interval", 0, "Seconds between logged summaries of peer counts: total, online, offline, direct and relayed (0 disables)")
+	metricsAddr      = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on at /metrics (disabled if empty)")
+	webuiAddr        = flag.String("webui-addr", "", "Tailnet address to serve the peer web UI on (e.g., :8080; disabled if empty)")
+	adminSocket      = flag.String("admin-socket", "", "Unix socket to serve the admin API on, used by the query subcommand (e.g., /var/run/tsmagicproxy.sock; disabled if empty)")
+	statsdAddr       = flag.String("statsd-addr", "", "StatsD server address to publish metrics to over UDP (e.g., localhost:8125; disabled if empty)")
+	statsdInterval   = flag.Int("statsd-interval", 10, "Seconds between StatsD metric publishes")
+	statsdPrefix     = flag.String("statsd-prefix", "tsmagicproxy.", "Prefix prepended to StatsD metric names")
+	exposeVersion    = flag.Bool("expose-version-chaos", false, "Include the version in answers to version.bind CHAOS TXT queries")
+	serverID         = flag.String("server-id", "", "Identifier answered for id.server CHAOS TXT queries, to tell instances apart (default: -hostname)")
+	validateOnly     = flag.Bool("validate-config", false, "Validate the configuration, print a summary and exit")
+	printVersion     = flag.Bool("version", false, "Print the version and exit")
+	staticPeersFile  = flag.String("static-peers-file", "", "Serve DNS from a tailnet status saved with \"tailscale status --json\", reloaded every 30 seconds, instead of connecting to the tailnet")
+	dryRun           = flag.Bool("dry-run", false, "Connect to the tailnet, print the answers to -dry-run-queries and exit without serving DNS")
+	dryRunQueries    = flag.String("dry-run-queries", "", "File of \"name type\" lines to resolve with -dry-run")
+	shuffleRecords   = flag.Bool("shuffle-answers", false, "Randomize the order of address records in answers to spread load across a peer's addresses")
+	anyReturnsAll    = flag.Bool("any-returns-all", false, "Answer ANY queries with all known records for the name instead of the minimal RFC 8482 HINFO record")
+	testLatency      = flag.Int("test-latency", 0, "Milliseconds to delay responses by, to test how clients cope with slow DNS; never use in production (0 disables)")
+	testJitter       = flag.Int("test-latency-jitter", 0, "Milliseconds of random jitter added to or subtracted from -test-latency")
+	testLatencyRate  = flag.Float64("test-latency-rate", 1.0, "Fraction of queries (0.0 to 1.0) that -test-latency delays")
+	connectRetries   = flag.Int("connect-retries", 0, "Times to retry connecting to the tailnet before exiting (0 exits on the first failure, -1 retries forever)")
+	connectInterval  = flag.Int("connect-retry-interval", 10, "Seconds between attempts to connect to the tailnet")
+	serveReconnect   = flag.Bool("serve-during-reconnect", false, "Serve SERVFAIL while retrying the tailnet connection, instead of not listening until connected")
+	requireConnected = flag.Bool("require-connected", true, "Wait for the tailnet connection before serving DNS; if false, serve SERVFAIL until connected")
+)
+
+// Build information, set at build time with -ldflags, e.g.
+// "-X main.version=v1.2.3 -X main.commit=abc1234 -X main.buildDate=2025-01-01T00:00:00Z".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
 )
 
+// startTime is when the process started, for reporting uptime.
+var startTime = time.Now()
+
+func init() {
+	flag.Usage = printUsage
+	flag.Var(weightedRecordFlags, "weighted-record", "Weighted record as name=peer:weight,peer:weight; answers with one peer chosen at random by weight (repeatable)")
+	flag.Var(funnelRecordFlags, "funnel-record", "Funnel URL to publish for a peer as peer=url, answered for TXT queries of _funnel.<peer> (repeatable)")
+	flag.Var(typeUpstreamFlags, "type-upstream", "Upstreams for one query type as TYPE=upstream[,upstream], in the -upstream syntax, used instead of -upstream for forwarded queries of that type, e.g. MX=mail-resolver:53 (repeatable)")
+	flag.Var(dnameFlags, "dname", "DNAME record as from-zone=to-zone; names under from-zone are redirected to the same names under to-zone (repeatable)")
+	flag.Var(ipTypeOverrideFlags, "ip-type-override", "Address type for one peer as peer=ipv4|ipv6|both, overriding -ip-type, e.g. for peers with broken IPv6 paths (repeatable)")
+	flag.Var(&webhookURLFlags, "webhook-url", "URL to POST a JSON event to when a peer joins or leaves the tailnet or its IPs change, retried 3 times (repeatable)")
+	flag.Var(healthCheckFlags, "health-check", "Health check as peer=url; the peer is left out of answers after -health-check-threshold consecutive failures (repeatable)")
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "query" {
+		runQuery(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
-	if *authKey == "" {
-		log.Fatal("auth key must be provided via -authkey flag or TS_AUTHKEY environment variable")
+	if *printVersion {
+		fmt.Printf("tsmagicproxy %s (commit %s, built %s, %s)\n", version, commit, buildDate, runtime.Version())
+		os.Exit(0)
 	}
+	setupLogging(*logFormat)
+	log.Printf("tsmagicproxy version=%s commit=%s built=%s", version, commit, buildDate)
 
-	// Ensure state directory exists
-	if err := os.MkdirAll(*stateDir, 0700); err != nil {
-		log.Fatalf("Failed to create state directory: %v", err)
+	errs := validateConfig()
+	if *validateOnly {
+		printConfigSummary(errs)
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Invalid configuration: %v", err)
+		}
+		os.Exit(1)
 	}
+	logConfigSummary(context.Background())
 
-	// Set force login env var if requested
-	if *forceLogin {
-		os.Setenv("TSNET_FORCE_LOGIN", "1")
+	upstreams, tlsUpstreams := parseUpstreams(*upstream, *upstreamTLS)
+	byType, byTypeTLS := typeUpstreamFlags.parse(*upstreamTLS)
+	maps.Copy(tlsUpstreams, byTypeTLS)
+	dnsServer := &DNSServer{
+		staticPeers:   *staticPeersFile,
+		debug:         *debug,
+		axfrAllowFrom: mustParsePrefixList(*axfrAllowFrom),
+		serial:        zoneSerial{history: zoneHistory{size: *ixfrHistory}},
+		upstreams:     upstreams,
+		tlsUpstreams:  tlsUpstreams,
+		typeUpstreams: byType,
+		dohClient:     newDoHClient(time.Duration(*dohTimeout)*time.Second, *upstreamInsecure),
+		outOfZone:     outOfZonePolicy(*outOfZone, *upstream),
+		qnameMinimize: *qnameMinimize,
+		stripECS:      *stripECS,
+		minimal:       *responseMinimize,
+		magicDNS:      *passthrough,
+		weighted:      weightedRecordFlags,
+		dnames:        dnameFlags,
+		ownedZones:    mustParseOwnedZones(*ownedZones),
+		tagZones:      mustParseTagZones(*tagZoneList),
+		sharedDomain:  strings.Trim(*sharedDomain, "."),
+		excludeIPs:    mustParsePrefixList(*excludeIPs),
+		includeIPs:    mustParsePrefixList(*includeOnlyIPs),
+		ipType:        strings.ToLower(*ipType),
+		ipTypes:       ipTypeOverrideFlags,
+		ipSelect:      strings.ToLower(*ipSelect),
+		shortNames:    strings.ToLower(*shortNameMode),
 	}
 
-	// Create the tsnet server
-	s := &tsnet.Server{
-		Hostname: *hostname,
-		AuthKey:  *authKey,
-		Dir:      *stateDir,
+	// Check the proxy's dependencies before connecting to the tailnet, as a
+	// failed start is hard to debug in short-lived containers
+	if errs := dnsServer.checkDependencies(); len(errs) > 0 {
+		for _, err := range errs {
+			log.Printf("Startup check failed: %v", err)
+		}
+		os.Exit(1)
 	}
-	defer s.Close()
 
-	// Start the server to connect to the tailnet
-	log.Printf("Connecting to tailnet with hostname %s...", *hostname)
-	if err := s.Start(); err != nil {
-		log.Fatalf("Error starting tsnet server: %v", err)
+	// Cancelled on SIGINT or SIGTERM, to stop retrying the tailnet
+	// connection. Until the handler below is installed, those signals end
+	// the process outright.
+	shutdownCtx, cancelShutdown := context.WithCancel(context.Background())
+
+	// With -static-peers-file there is no tailnet connection at all
+	var s *tsnet.Server
+	if *staticPeersFile == "" {
+		s = startTailnet(shutdownCtx)
+		defer s.Close()
+		dnsServer.tsnet = s
 	}
 
-	// Wait for the connection to be established
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-	status, err := s.Up(ctx)
+	// On SIGINT or SIGTERM, drain in-flight queries before closing the
+	// tailnet connection
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, shutting down", sig)
+		cancelShutdown()
+		dnsServer.Shutdown()
+		if s != nil {
+			s.Close()
+		}
+		os.Exit(0)
+	}()
+
+	if *peerServeConfig != "" {
+		configs, err := loadPeerServeConfigs(*peerServeConfig)
+		if err != nil {
+			log.Fatalf("Error loading peer serve configs: %v", err)
+		}
+		dnsServer.peerServe = configs
+		log.Printf("Loaded serve configs for %d peers", len(configs))
+	}
+	if *rrlRate > 0 {
+		dnsServer.rrl = newResponseLimiter(*rrlRate, time.Duration(*rrlWindow)*time.Second, *rrlPrefixLen)
+	}
+	if *maxQueries > 0 {
+		dnsServer.slots = newQuerySlots(*maxQueries, time.Duration(*queueTimeout)*time.Millisecond)
+	}
+	if *nxAlertThreshold > 0 {
+		dnsServer.nxStorms = newNXStormDetector(*nxAlertThreshold, time.Duration(*nxAlertWindow)*time.Second)
+	}
+
+	// The DNS cookie secret is kept with the tailnet state, which
+	// -static-peers-file does without, so there it lasts one run
+	cookieDir := *stateDir
+	if *staticPeersFile != "" {
+		cookieDir = ""
+	}
+	cookies, err := loadCookieJar(cookieDir)
 	if err != nil {
-		log.Fatalf("Error connecting to tailnet: %v", err)
+		log.Fatalf("Error loading DNS cookie secret: %v", err)
 	}
+	dnsServer.cookies = cookies
 
-	log.Printf("Connected to tailnet as %s with IP %v", status.Self.DNSName, status.TailscaleIPs)
+	if *testLatency > 0 {
+		dnsServer.latency = &latencyInjector{
+			delay:  time.Duration(*testLatency) * time.Millisecond,
+			jitter: time.Duration(*testJitter) * time.Millisecond,
+			rate:   *testLatencyRate,
+		}
+		log.Printf("Delaying %.0f%% of responses by %v ± %v for testing", *testLatencyRate*100, dnsServer.latency.delay, dnsServer.latency.jitter)
+	}
 
-	// If domain suffix is not specified, extract it from Self.DNSName
-	if *domain == "" && status.Self.DNSName != "" {
-		parts := strings.SplitN(status.Self.DNSName, ".", 2)
-		if len(parts) > 1 {
-			*domain = parts[1]
-			log.Printf("Detected domain suffix: %s", *domain)
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	if *webuiAddr != "" {
+		go dnsServer.serveWebUI(*webuiAddr)
+	}
+	if *adminSocket != "" {
+		go dnsServer.serveAdmin(*adminSocket)
+	}
+	if *statsdAddr != "" {
+		go runStatsD(*statsdAddr, *statsdPrefix, time.Duration(*statsdInterval)*time.Second)
+	}
+	if *probePeers {
+		dnsServer.prober = newPeerProber(*probePort, time.Duration(*probeTTL)*time.Second)
+		log.Printf("Probing peers on TCP port %d every %v", *probePort, dnsServer.prober.ttl/2)
+		go dnsServer.prober.run(dnsServer)
+	}
+	if len(healthCheckFlags) > 0 {
+		dnsServer.health = newHealthChecker(healthCheckFlags, time.Duration(*healthInterval)*time.Second,
+			time.Duration(*healthTimeout)*time.Second, *healthThreshold)
+		go dnsServer.health.run(dnsServer)
+	}
+	if *rpzFile != "" || *rpzURL != "" {
+		policy, err := loadRPZ()
+		if err != nil {
+			log.Fatalf("Error loading RPZ: %v", err)
 		}
+		dnsServer.rpz.Store(policy)
+		log.Printf("Loaded RPZ: %d QNAME and %d response-IP triggers", len(policy.qnames), len(policy.ips))
+		go dnsServer.refreshRPZ()
+	}
+
+	// Without -require-connected, start answering right away and return
+	// SERVFAIL until the tailnet connection comes up. With
+	// -serve-during-reconnect, do the same once a connection attempt fails.
+	serving := false
+	serveEarly := func(when string) {
+		if serving || *dryRun || *tailscaleOnly {
+			return
+		}
+		serving = true
+		log.Printf("Starting DNS server on %v %s", listenAddrs(), when)
+		go dnsServer.Start(listenAddrs())
+	}
+	if !*requireConnected {
+		serveEarly("before tailnet is connected")
+	}
+
+	// Wait for the connection to be established
+	var status *ipnstate.Status
+	if *staticPeersFile != "" {
+		var err error
+		status, err = loadStaticStatus(*staticPeersFile)
+		if err != nil {
+			log.Fatalf("Error loading static peers: %v", err)
+		}
+		log.Printf("Loaded static peers as %s with IP %v", status.Self.DNSName, status.TailscaleIPs)
+	} else {
+		var err error
+		status, err = connectTailnet(shutdownCtx, s, func() {
+			if *serveReconnect {
+				serveEarly("while retrying the tailnet connection")
+			}
+		})
+		if shutdownCtx.Err() != nil {
+			select {} // the signal handler exits once queries drain
+		}
+		if err != nil {
+			log.Fatalf("Error connecting to tailnet: %v", err)
+		}
+		log.Printf("Connected to tailnet as %s with IP %v", status.Self.DNSName, status.TailscaleIPs)
+	}
+
+	// If domain suffix is not specified, extract it from Self.DNSName
+	if selfName := status.Self.DNSName; *domain == "" && dnsname.NumLabels(selfName) > 1 {
+		*domain = strings.TrimPrefix(selfName, dnsname.FirstLabel(selfName)+".")
+		log.Printf("Detected domain suffix: %s", *domain)
 	}
 
 	// Log all available DNS names in the tailnet
@@ -86,131 +365,880 @@ func main() {
 		}
 	}
 
-	// Create DNS server
-	dnsServer := &DNSServer{
-		tsnet:  s,
-		status: status,
-		domain: *domain,
-		debug:  *debug,
+	// Set before SetStatus so handlers see it once they see the status
+	if *departedGrace > 0 {
+		dnsServer.departures = newDepartureTracker(time.Duration(*departedGrace) * time.Second)
+		dnsServer.departures.observe(status)
+	}
+	// Peers already in the tailnet are the baseline, not joins
+	var webhooks *webhookNotifier
+	if len(webhookURLFlags) > 0 {
+		events, _ := parseWebhookEvents(*webhookEvents)
+		webhooks = newWebhookNotifier(webhookURLFlags, events, time.Duration(*webhookTimeout)*time.Second)
+		webhooks.observe(status)
+	}
+
+	// The shared-peer zone is accepted alongside the tailnet domains, but
+	// never becomes the primary domain
+	zones := domainList(*domain, *domains)
+	if d := dnsServer.sharedDomain; d != "" && len(zones) > 0 && !slices.Contains(zones, d) {
+		zones = append(zones, d)
+	}
+	dnsServer.SetStatus(status, zones)
+
+	// A dry run changes nothing, so it exits before anything that sends
+	// NOTIFYs, writes zone files or otherwise acts on the status starts
+	if *dryRun {
+		ok, err := dnsServer.dryRun(*dryRunQueries)
+		if err != nil {
+			log.Fatalf("Dry run failed: %v", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *staticPeersFile != "" {
+		go dnsServer.reloadStaticPeers(*staticPeersFile)
+	} else {
+		go dnsServer.watchPeers()
+		go dnsServer.watchKeyExpiry(*authKeyURL, time.Duration(*keyExpiryAlert)*time.Second)
+	}
+	if dnsServer.departures != nil {
+		go dnsServer.departures.run(dnsServer)
+	}
+	if webhooks != nil {
+		log.Printf("Sending peer lifecycle events to %d webhooks", len(webhookURLFlags))
+		go webhooks.run(dnsServer)
+	}
+	if *statusInterval > 0 {
+		go dnsServer.logStatusSummaries(time.Duration(*statusInterval) * time.Second)
+	}
+
+	if secondaries := upstreamList(*notifyAddrs); len(secondaries) > 0 {
+		go dnsServer.watchZone(secondaries)
+	}
+	if *zoneFile != "" {
+		go dnsServer.writeZoneFiles(*zoneFile, strings.ToLower(*zoneFileFormat))
+	}
+
+	if *unixSocket != "" {
+		mode, _ := parseSocketMode(*unixSocketMode)
+		go dnsServer.ServeUnix(*unixSocket, mode)
+	}
+
+	// With -tailscale-only, serve on this node's Tailscale IPs through tsnet
+	// rather than on host interfaces
+	if *tailscaleOnly {
+		_, port, _ := net.SplitHostPort(*listen)
+		log.Printf("Starting DNS server on tailnet addresses %v, port %s", status.TailscaleIPs, port)
+		dnsServer.StartTailnet(status.TailscaleIPs, port)
+	}
+
+	if !*requireConnected || serving {
+		select {}
 	}
 
 	// Start DNS server
-	log.Printf("Starting DNS server on %s", *listen)
-	dnsServer.Start(*listen)
+	log.Printf("Starting DNS server on %v", listenAddrs())
+	dnsServer.Start(listenAddrs())
+}
+
+// startTailnet starts a tsnet server that connects to the tailnet in the
+// background. A server that failed to start cannot be started again, so each
+// retry uses a new one.
+func startTailnet(ctx context.Context) *tsnet.Server {
+	// Ensure state directory exists
+	if err := os.MkdirAll(*stateDir, 0700); err != nil {
+		log.Fatalf("Failed to create state directory: %v", err)
+	}
+
+	// Set force login env var if requested
+	if *forceLogin {
+		os.Setenv("TSNET_FORCE_LOGIN", "1")
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Create the tsnet server
+		s := &tsnet.Server{
+			Hostname: *hostname,
+			AuthKey:  *authKey,
+			Dir:      *stateDir,
+		}
+
+		// Start the server to connect to the tailnet
+		log.Printf("Connecting to tailnet with hostname %s...", *hostname)
+		err := s.Start()
+		if err == nil {
+			return s
+		}
+		s.Close()
+		if !retryConnect(ctx, attempt, err) {
+			log.Fatalf("Error starting tsnet server: %v", err)
+		}
+	}
 }
 
 // DNSServer implements a DNS server that proxies requests to Tailscale's MagicDNS
 type DNSServer struct {
-	tsnet  *tsnet.Server
-	status *ipnstate.Status
-	domain string
-	debug  bool
+	tsnet *tsnet.Server // nil with -static-peers-file
+	debug bool
+
+	axfrAllowFrom []netip.Prefix
+	serial        zoneSerial
+	upstreams     []string
+	typeUpstreams map[uint16][]string
+	tlsUpstreams  map[string]string // DNS-over-TLS server name by upstream
+	dohClient     *http.Client      // for https:// upstreams
+	outOfZone     string
+	qnameMinimize bool
+	stripECS      bool
+	minimal       bool
+	magicDNS      bool
+	prober        *peerProber       // nil unless -probe-peers
+	health        *healthChecker    // nil unless -health-check
+	departures    *departureTracker // nil unless -departed-grace
+	sharedDomain  string            // zone for peers shared from other tailnets
+	excludeIPs    []netip.Prefix
+	includeIPs    []netip.Prefix
+	ipType        string
+	ipTypes       ipTypeOverrides
+	ipSelect      string
+	shortNames    string // -short-name-conflicts policy
+	weighted      weightedRecords
+	dnames        dnameRecords
+	tagZones      tagZones
+	ownedZones    []string                  // -owned-zones, as lowercase FQDNs
+	peerServe     peerServeConfigs          // nil unless -peer-serve-config-file
+	rrl           *responseLimiter          // nil if -rrl-rate is 0
+	slots         *querySlots               // nil if -max-concurrent-queries is 0
+	cookies       *cookieJar                // nil disables DNS Cookies
+	latency       *latencyInjector          // nil unless -test-latency
+	nxStorms      *nxStormDetector          // nil if -nxdomain-alert-threshold is 0
+	staticPeers   string                    // -static-peers-file, read instead of tailscaled
+	rpz           atomic.Pointer[rpzPolicy] // nil unless -rpz-file or -rpz-url
+
+	// Servers and in-flight queries, tracked for graceful shutdown
+	serversMu    sync.Mutex
+	servers      []*dns.Server
+	inflight     inflightQueries
+	shuttingDown atomic.Bool
+
+	// status is nil until the tailnet connection is up, and is then
+	// refreshed on every network map or engine update or -static-peers-file
+	// reload, which are published to updates, and by queries while the IPN
+	// bus is not being watched. domain and domains are only written before
+	// status is first stored, so handlers may read them once they have seen
+	// a non-nil status.
+	status   atomic.Pointer[ipnstate.Status]
+	updates  statusUpdates
+	watching atomic.Bool // the IPN bus watch is keeping status current
+	domain   string      // primary domain suffix
+	domains  []string    // all accepted suffixes, primary first
+}
+
+// SetStatus records the connected tailnet status and the accepted domain
+// suffixes, primary first, after which the server starts answering queries.
+func (s *DNSServer) SetStatus(status *ipnstate.Status, domains []string) {
+	if len(domains) > 0 {
+		s.domain = domains[0]
+	}
+	s.domains = domains
+	s.status.Store(status)
+}
+
+// trimDomain strips the first configured domain suffix that name ends
+// with, ignoring case, and returns the rest lowercased. Names matching no
+// domain are returned whole, lowercased.
+func (s *DNSServer) trimDomain(name string) string {
+	name = strings.ToLower(name)
+	for _, d := range s.domains {
+		if d = strings.ToLower(d); dnsname.HasSuffix(name, d) {
+			return dnsname.TrimSuffix(name, d)
+		}
+	}
+	return name
+}
+
+// inZone reports whether name is one the server answers for itself: a name
+// under a configured domain or a tag zone, a bare hostname, a weighted
+// record, or a reverse name for a Tailscale IP, in any case. With no
+// domains configured, every name is in zone.
+func (s *DNSServer) inZone(name string) bool {
+	if len(s.domains) == 0 || dnsname.NumLabels(name) <= 1 {
+		return true
+	}
+	// Clients may randomize the case of names (0x20 encoding), so names
+	// and domains are compared lowercased
+	name = strings.ToLower(name)
+	if _, ok := s.weighted[dnsname.TrimSuffix(name, ".")]; ok {
+		return true
+	}
+	if _, _, ok := s.dnames.match(name); ok {
+		return true
+	}
+	for _, d := range s.domains {
+		if dns.IsSubDomain(strings.ToLower(dns.Fqdn(d)), dns.Fqdn(name)) {
+			return true
+		}
+	}
+	if _, ok := s.ownedZone(name); ok {
+		return true
+	}
+	if _, _, ok := s.tagZones.match(name); ok {
+		return true
+	}
+	if ip := extractIPFromReverseDNS(name); ip.IsValid() {
+		return tsaddr.IsTailscaleIP(ip)
+	}
+	return false
+}
+
+// listenAddr is an address to serve DNS on. family is "4" or "6" to bind a
+// socket for that address family only, or "" to leave it to the OS.
+type listenAddr struct {
+	addr   string
+	family string
+}
+
+func (l listenAddr) String() string { return l.addr }
+
+// listenAddrs returns the addresses to serve DNS on. -listen-ipv4 and
+// -listen-ipv6 bind separate sockets per family; -listen is used alone if
+// neither is set, and alongside them if it was given explicitly.
+func listenAddrs() []listenAddr {
+	var addrs []listenAddr
+	if *listen4 != "" {
+		addrs = append(addrs, listenAddr{*listen4, "4"})
+	}
+	if *listen6 != "" {
+		addrs = append(addrs, listenAddr{*listen6, "6"})
+	}
+	if len(addrs) == 0 || flagWasSet("listen") {
+		addrs = append(addrs, listenAddr{*listen, ""})
+	}
+	return addrs
+}
+
+// Start the DNS server on the specified addresses, serving UDP and TCP on
+// each from a shared handler
+func (s *DNSServer) Start(addrs []listenAddr) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.handleDNSRequest)
+
+	// Serve TCP alongside UDP for zone transfers and large responses
+	errc := make(chan error)
+	for _, l := range addrs {
+		for _, proto := range []string{"udp", "tcp"} {
+			server := &dns.Server{Addr: l.addr, Net: proto + l.family, Handler: mux}
+			s.trackServer(server)
+			go func() { errc <- server.ListenAndServe() }()
+		}
+	}
+	s.serveUntilError(errc)
+}
+
+// StartTailnet serves DNS over UDP and TCP on port of each of ips, which must
+// be this node's Tailscale IPs. The sockets belong to tsnet's userspace
+// network stack, so only tailnet clients can reach them.
+func (s *DNSServer) StartTailnet(ips []netip.Addr, port string) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", s.handleDNSRequest)
+
+	errc := make(chan error)
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), port)
+		pc, err := s.tsnet.ListenPacket("udp", addr)
+		if err != nil {
+			log.Fatalf("Error listening on %s/udp: %v", addr, err)
+		}
+		ln, err := s.tsnet.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("Error listening on %s/tcp: %v", addr, err)
+		}
+		for _, server := range []*dns.Server{
+			{PacketConn: pc, Handler: mux},
+			{Listener: ln, Handler: mux},
+		} {
+			s.trackServer(server)
+			go func() { errc <- server.ActivateAndServe() }()
+		}
+	}
+	s.serveUntilError(errc)
 }
 
-// Start the DNS server on the specified address
-func (s *DNSServer) Start(addr string) {
-	dns.HandleFunc(".", s.handleDNSRequest)
+// fetchStatus gets the current status to have the latest peer information
+func (s *DNSServer) fetchStatus() (*ipnstate.Status, error) {
+	if s.staticPeers != "" {
+		return s.staticStatus()
+	}
+	// While the IPN bus is watched, the stored status is replaced on every
+	// network map and engine update, so it is as current as asking
+	// tailscaled, endpoints included
+	if s.watching.Load() {
+		if status := s.status.Load(); status != nil {
+			return status, nil
+		}
+	}
+	return s.queryStatus()
+}
+
+// queryStatus asks tailscaled for the current status.
+func (s *DNSServer) queryStatus() (*ipnstate.Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Start server on UDP
-	server := &dns.Server{Addr: addr, Net: "udp"}
-	log.Fatal(server.ListenAndServe())
+	lc, err := s.tsnet.LocalClient()
+	if err != nil {
+		return nil, fmt.Errorf("getting local client: %w", err)
+	}
+	start := time.Now()
+	status, err := lc.Status(ctx)
+	metricStatusFetch.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	// Keep the stored status current for readers that must not query
+	// tailscaled themselves, once SetStatus has stored the first one
+	if s.status.Load() != nil {
+		s.status.Store(status)
+	}
+	return status, nil
 }
 
 // handleDNSRequest processes incoming DNS requests
 func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, r *dns.Msg) {
+	dw := s.inflight.start(w, r)
+	defer s.inflight.finish(dw)
+	w = dw
+
+	// Only queries are answered: this proxy is never a secondary and takes
+	// no dynamic updates. The DNS library refuses most other opcodes
+	// itself, but passes NOTIFY through.
+	if r.Opcode != dns.OpcodeQuery {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		w.WriteMsg(m)
+		return
+	}
+
+	// Extended DNS Errors are only sent to clients that use EDNS0
+	if r.IsEdns0() == nil {
+		w = ednsWriter{w}
+	}
+	if s.nxStorms != nil {
+		w = nxStormWriter{w, s.nxStorms}
+	}
+
+	// Clients that return a valid server cookie have proven they are not
+	// spoofing their address, so they are not rate limited
+	w, validCookie, handled := s.handleCookies(w, r)
+	if handled {
+		return
+	}
+	if !validCookie && s.rateLimited(w, r) {
+		return
+	}
+	if s.overloaded(w, r) {
+		return
+	}
+	if s.slots != nil {
+		defer s.slots.release()
+	}
+	if s.latency != nil {
+		s.latency.wait()
+	}
+
+	// Every line logged for the query carries the client's address
+	qlog := slog.With("client", extractClientIP(w.RemoteAddr()))
+
 	m := new(dns.Msg)
 	m.SetReply(r)
 	m.Authoritative = true
 	m.RecursionAvailable = false
 
-	// Process each question
+	// Names over 255 octets or with labels over 63 octets are malformed
+	// (RFC 1035 section 2.3.4), as are questions for types that only
+	// appear in other sections. One bad question fails the whole message
+	// rather than leaving it partly answered (RFC 9619).
+	for _, q := range r.Question {
+		if !validQname(q.Name) {
+			qlog.Warn("Malformed query name, returning FORMERR", "name_bytes", len(q.Name))
+			m.Rcode = dns.RcodeFormatError
+			w.WriteMsg(m)
+			return
+		}
+		if !validQtype(q.Qtype) {
+			qlog.Warn("Invalid query type, returning FORMERR", "name", q.Name, "type", dns.TypeToString[q.Qtype])
+			m.Rcode = dns.RcodeFormatError
+			w.WriteMsg(m)
+			return
+		}
+	}
+
+	// CHAOS class identity queries need no tailnet connection
+	if len(r.Question) == 1 && r.Question[0].Qclass == dns.ClassCHAOS {
+		s.handleCHAOS(r.Question[0], m)
+		w.WriteMsg(m)
+		return
+	}
+
+	if s.status.Load() == nil {
+		qlog.Warn("Not connected to tailnet yet, returning SERVFAIL")
+		m.Rcode = dns.RcodeServerFailure
+		addExtendedError(m, dns.ExtendedErrorCodeNotReady, "not connected to the tailnet yet")
+		w.WriteMsg(m)
+		return
+	}
+
+	// Monitoring sentinel names are answered once connected, before any
+	// lookup or policy
+	if len(r.Question) == 1 && s.handleSentinel(r.Question[0], m) {
+		w.WriteMsg(m)
+		return
+	}
+
+	// Response policy zone QNAME triggers apply to every query
+	if s.applyQNamePolicy(w, r, m) {
+		return
+	}
+
+	// Queries outside the tailnet zones are refused or forwarded
+	for _, q := range r.Question {
+		if !s.inZone(q.Name) {
+			s.handleOutOfZone(w, r, m)
+			return
+		}
+	}
+
+	// Zone transfers stream their own multi-message response
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeAXFR {
+		s.handleAXFR(w, r)
+		return
+	}
+	if len(r.Question) == 1 && r.Question[0].Qtype == dns.TypeIXFR {
+		s.handleIXFR(w, r)
+		return
+	}
+
+	// With -magicdns-passthrough, tailscaled resolves tailnet names
+	if len(r.Question) == 1 && s.passthrough(r.Question[0]) {
+		s.handleMagicDNS(w, r, m)
+		return
+	}
+
+	// Process each question. Answers follow the order of the questions,
+	// and where each question's answers start is kept so they can be
+	// shuffled among themselves only.
+	starts := make([]int, 0, len(r.Question))
 	for _, q := range r.Question {
-		log.Printf("Query: %s %s", q.Name, dns.TypeToString[q.Qtype])
+		qlog.Info("Query", "name", q.Name, "type", dns.TypeToString[q.Qtype])
+		starts = append(starts, len(m.Answer))
+
+		if s.handleDNAME(q, m, qlog) {
+			continue
+		}
 
 		switch q.Qtype {
 		case dns.TypeA, dns.TypeAAAA:
-			s.handleAddressQuery(q, m)
+			s.handleAddressQuery(q, m, qlog)
 		case dns.TypePTR:
-			s.handlePTRQuery(q, m)
-		case dns.TypeTXT, dns.TypeCNAME, dns.TypeSRV:
-			// For now we don't implement these record types
+			s.handlePTRQuery(q, m, qlog)
+		case dns.TypeNS:
+			s.handleNSQuery(q, m)
+		case dns.TypeSOA:
+			s.handleSOAQuery(q, m)
+		case dns.TypeTXT:
+			s.handleTXTQuery(q, m, qlog)
+		case dns.TypeSRV:
+			switch {
+			case *useNodeAttrs && s.handleNodeAttrSRV(q, m, qlog):
+			case *autoSRV:
+				s.handleSRVQuery(q, m, qlog)
+			}
+		case dns.TypeHTTPS:
+			if *autoHTTPSHints {
+				s.handleHTTPSQuery(q, m)
+			}
+		case dns.TypeNAPTR:
+			if *exposeTagsNAPTR {
+				s.handleNAPTRQuery(q, m, qlog)
+			}
+		case dns.TypeANY:
+			s.handleANYQuery(q, m, qlog)
+		case dns.TypeCNAME:
+			// For now we don't implement this record type
 		}
 	}
 
+	if len(r.Question) == 1 {
+		s.addOwnedZoneAuthority(r.Question[0], m)
+	}
+
 	// Log the response
-	if s.debug {
-		log.Printf("Response: %v", m)
-	} else {
-		log.Printf("Response has %d answers", len(m.Answer))
+	switch {
+	case s.debug && *logFormat == "json":
+		qlog.Info("Response", "response", dnsMsgToMap(m))
+	case s.debug:
+		qlog.Info("Response", "msg", m.String())
+	default:
+		qlog.Info("Response", "answers", len(m.Answer))
 	}
 
-	w.WriteMsg(m)
+	if *shuffleRecords {
+		for i, start := range starts {
+			end := len(m.Answer)
+			if i+1 < len(starts) {
+				end = starts[i+1]
+			}
+			shuffleAnswers(m.Answer[start:end])
+		}
+	}
+	if s.minimal {
+		minimizeResponse(m)
+	}
+	if s.applyResponsePolicy(m) {
+		w.WriteMsg(m)
+	}
 }
 
-// handleAddressQuery handles A and AAAA queries
-func (s *DNSServer) handleAddressQuery(q dns.Question, m *dns.Msg) {
-	// Get the current status to have the latest peer information
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	
-	lc, err := s.tsnet.LocalClient()
-	if err != nil {
-		log.Printf("Error getting local client: %v", err)
+// validQname reports whether name is a well-formed domain name of at most
+// 255 octets in wire format.
+func validQname(name string) bool {
+	if _, ok := dns.IsDomainName(name); !ok {
+		return false
+	}
+	// IsDomainName allows one octet more than RFC 1035 does
+	buf := make([]byte, 256)
+	n, err := dns.PackDomainName(dns.Fqdn(name), buf, 0, nil, false)
+	return err == nil && n <= 255
+}
+
+// validQtype reports whether t may be asked for in a question. Type 0 is
+// reserved, and OPT, TKEY and TSIG are meta-types that only appear in the
+// additional section (RFC 6895 section 3.1).
+func validQtype(t uint16) bool {
+	switch t {
+	case dns.TypeNone, dns.TypeOPT, dns.TypeTKEY, dns.TypeTSIG:
+		return false
+	}
+	return true
+}
+
+// handleANYQuery answers an ANY query with a single synthesized HINFO
+// record (RFC 8482 section 4.2), so ANY cannot be used to enumerate or
+// amplify. With -any-returns-all it returns every record type known for
+// the name instead.
+func (s *DNSServer) handleANYQuery(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	if *anyReturnsAll {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeTXT} {
+			sub := dns.Question{Name: q.Name, Qtype: qtype, Qclass: q.Qclass}
+			if qtype == dns.TypeTXT {
+				s.handleTXTQuery(sub, m, qlog)
+			} else {
+				s.handleAddressQuery(sub, m, qlog)
+			}
+		}
 		return
 	}
-	
-	status, err := lc.Status(ctx)
+	m.Answer = append(m.Answer, &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    uint32(*ttl),
+		},
+		Cpu: "RFC8482",
+	})
+}
+
+// handleAddressQuery handles A and AAAA queries
+func (s *DNSServer) handleAddressQuery(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	status, err := s.fetchStatus()
 	if err != nil {
-		log.Printf("Error getting status: %v", err)
+		qlog.Error("Error getting status", "err", err)
+		statusUnavailable(m)
 		return
 	}
 
 	qname := dnsname.TrimSuffix(q.Name, ".")
-	
+
 	if s.debug {
-		log.Printf("Looking up: %s", qname)
+		qlog.Info("Looking up", "name", qname)
 	}
-	
-	// Check for matches among peers
-	for _, peer := range status.Peer {
+
+	// Weighted records pick one of several peers for each query
+	lookup := qname
+	if targets, ok := s.weighted[strings.ToLower(qname)]; ok {
+		lookup = pickWeighted(targets)
+		qlog.Info("Weighted record selected peer", "name", qname, "peer", lookup)
+	}
+
+	if s.shortNames == conflictServFail {
+		if peers := s.ambiguousPeers(status, lookup); peers != nil {
+			qlog.Warn("Name matches several peers by base name, returning SERVFAIL; query the full name instead",
+				"name", lookup, "peers", peerNames(peers))
+			m.Rcode = dns.RcodeServerFailure
+			addExtendedError(m, dns.ExtendedErrorCodeOther, "name matches several peers; query the full name")
+			return
+		}
+	}
+
+	peer := s.findPeer(status, lookup, qlog)
+	if peer == nil {
+		if s.departures != nil && s.departures.departed(s, lookup) {
+			qlog.Info("Peer recently departed, returning NXDOMAIN", "peer", lookup)
+			m.Rcode = dns.RcodeNameError
+			return
+		}
+		qlog.Info("No match found", "name", lookup)
+		return
+	}
+
+	answers := len(m.Answer)
+	s.addPeer(q, m, peer, qlog)
+	if len(m.Answer) == answers {
+		qlog.Info("Peer matched but no records were added", "peer", peer.DNSName, "type", dns.TypeToString[q.Qtype])
+	}
+}
+
+// findPeer returns the peer whose DNS name matches qname, or nil if none
+// does. An exact match of the full name comes first, then a match in a
+// -tag-zones zone, then a match by base name under a configured domain.
+func (s *DNSServer) findPeer(status *ipnstate.Status, qname string, qlog *slog.Logger) *ipnstate.PeerStatus {
+	// Names in the shared-peer zone only resolve to nodes shared in from
+	// other tailnets
+	if d := strings.ToLower(s.sharedDomain); d != "" && dnsname.HasSuffix(strings.ToLower(qname), d) {
+		return findSharedPeer(status, dnsname.TrimSuffix(strings.ToLower(qname), d), qlog)
+	}
+
+	start := time.Now()
+	exact, candidates := s.matchPeers(status, qname)
+	metricPeerMatch.Observe(time.Since(start).Seconds())
+	if exact != nil {
+		qlog.Info("Found exact match", "name", qname, "peer", dnsname.TrimSuffix(exact.DNSName, "."))
+		return exact
+	}
+	if peer := s.findTaggedPeer(status, qname, qlog); peer != nil {
+		return peer
+	}
+	switch len(candidates) {
+	case 0:
+		return nil
+	case 1:
+		qlog.Info("Found base match", "name", qname, "peer", dnsname.FirstLabel(candidates[0].DNSName))
+		return candidates[0]
+	}
+	return s.breakTie(qname, candidates, qlog)
+}
+
+// matchPeers returns the peer whose full name is qname, if any, and
+// otherwise every peer whose base name matches it. Full names are unique,
+// but several peers may share a base name. This node counts as a peer, so
+// clients can resolve the proxy itself.
+func (s *DNSServer) matchPeers(status *ipnstate.Status, qname string) (exact *ipnstate.PeerStatus, candidates []*ipnstate.PeerStatus) {
+	for _, peer := range peersAndSelf(status) {
 		// Skip peers without names
 		if peer.DNSName == "" {
 			continue
 		}
-		
+
 		peerName := dnsname.TrimSuffix(peer.DNSName, ".")
-		
+
 		if s.debug {
 			log.Printf("Checking against peer: %s", peerName)
 		}
-		
+
 		// Try exact match first
-		if qname == peerName {
-			log.Printf("Found exact match: %s = %s", qname, peerName)
-			addPeerToAnswer(q, m, *peer, *ttl)
-			return
+		if strings.EqualFold(qname, peerName) {
+			return peer, nil
 		}
-		
-		// Try hostname without domain if the query includes the domain
-		if s.domain != "" {
-			// If we have test.tailnet.ts.net and query is just for 'test'
-			peerBaseName := strings.SplitN(peerName, ".", 2)[0]
-			if qname == peerBaseName {
-				log.Printf("Found base match: %s = %s", qname, peerBaseName)
-				addPeerToAnswer(q, m, *peer, *ttl)
-				return
+
+		// Try hostname without domain if the query includes the domain.
+		// Shared peers have their own zone when one is configured, so a
+		// local peer's base name is never shadowed by one.
+		if len(s.domains) > 0 && !(peer.ShareeNode && s.sharedDomain != "") {
+			// If we have test.tailnet.ts.net and query is just for 'test',
+			// or for 'test' under any configured suffix
+			peerBaseName := strings.ToLower(dnsname.FirstLabel(peerName))
+			if s.trimDomain(qname) == peerBaseName {
+				candidates = append(candidates, peer)
 			}
 		}
 	}
-	
-	log.Printf("No match found for: %s", qname)
+	return nil, candidates
+}
+
+// breakTie picks one of several peers matching qname by base name, the
+// same one every time: a peer under the primary -domain first, then an
+// online peer, then the peer with the lowest Tailscale IP.
+func (s *DNSServer) breakTie(qname string, peers []*ipnstate.PeerStatus, qlog *slog.Logger) *ipnstate.PeerStatus {
+	inDomain := func(p *ipnstate.PeerStatus) bool {
+		return s.domain != "" && dnsname.HasSuffix(p.DNSName, s.domain)
+	}
+	slices.SortFunc(peers, func(a, b *ipnstate.PeerStatus) int {
+		if c := compareTrueFirst(inDomain(a), inDomain(b)); c != 0 {
+			return c
+		}
+		if c := compareTrueFirst(a.Online, b.Online); c != 0 {
+			return c
+		}
+		if c := compareLowestIP(a, b); c != 0 {
+			return c
+		}
+		return strings.Compare(a.DNSName, b.DNSName)
+	})
+
+	qlog.Warn("Name matches several peers by base name, using the first",
+		"name", qname, "peers", peerNames(peers), "peer", peers[0].DNSName)
+	return peers[0]
+}
+
+// peerNames returns the DNS names of peers.
+func peerNames(peers []*ipnstate.PeerStatus) []string {
+	names := make([]string, len(peers))
+	for i, p := range peers {
+		names[i] = p.DNSName
+	}
+	return names
+}
+
+// compareTrueFirst orders true before false.
+func compareTrueFirst(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return -1
+	}
+	return 1
 }
 
-// addPeerToAnswer adds appropriate resource records for a peer to the DNS answer
-func addPeerToAnswer(q dns.Question, m *dns.Msg, peer ipnstate.PeerStatus, ttl int) {
-	log.Printf("Found match for %s: %v", q.Name, peer.TailscaleIPs)
-	
+// compareLowestIP orders peers by their lowest Tailscale IP, with peers
+// that have none last.
+func compareLowestIP(a, b *ipnstate.PeerStatus) int {
+	ipA, okA := lowestIP(a)
+	ipB, okB := lowestIP(b)
+	if c := compareTrueFirst(okA, okB); c != 0 || !okA {
+		return c
+	}
+	return ipA.Compare(ipB)
+}
+
+func lowestIP(p *ipnstate.PeerStatus) (netip.Addr, bool) {
+	if len(p.TailscaleIPs) == 0 {
+		return netip.Addr{}, false
+	}
+	return slices.MinFunc(p.TailscaleIPs, netip.Addr.Compare), true
+}
+
+// peersAndSelf returns this node followed by every peer in status.
+func peersAndSelf(status *ipnstate.Status) []*ipnstate.PeerStatus {
+	nodes := make([]*ipnstate.PeerStatus, 0, len(status.Peer)+1)
+	if status.Self != nil {
+		nodes = append(nodes, status.Self)
+	}
+	for _, peer := range status.Peer {
+		nodes = append(nodes, peer)
+	}
+	return nodes
+}
+
+// findSharedPeer returns the peer shared in from another tailnet whose base
+// name is label.
+func findSharedPeer(status *ipnstate.Status, label string, qlog *slog.Logger) *ipnstate.PeerStatus {
+	for _, peer := range status.Peer {
+		if peer.ShareeNode && peer.DNSName != "" && strings.EqualFold(dnsname.FirstLabel(peer.DNSName), label) {
+			qlog.Info("Found shared peer match", "name", label, "peer", peer.DNSName)
+			return peer
+		}
+	}
+	return nil
+}
+
+// addPeer answers q with a matched peer's addresses, unless the peer is
+// excluded by server-side checks such as reachability probes. Addresses
+// outside the IP filters are left out.
+func (s *DNSServer) addPeer(q dns.Question, m *dns.Msg, peer *ipnstate.PeerStatus, qlog *slog.Logger) {
+	if s.prober != nil && !s.prober.reachable(peer) {
+		qlog.Info("Peer matched but has not passed a recent probe", "peer", peer.DNSName)
+		return
+	}
+	if s.health != nil && !s.health.healthy(peer) {
+		qlog.Info("Peer matched but is failing its health check", "peer", peer.DNSName)
+		return
+	}
+
+	filtered := *peer
+	if len(s.excludeIPs) > 0 || len(s.includeIPs) > 0 {
+		filtered.TailscaleIPs = nil
+		for _, addr := range peer.TailscaleIPs {
+			if s.ipAllowed(addr) {
+				filtered.TailscaleIPs = append(filtered.TailscaleIPs, addr)
+			}
+		}
+		if len(filtered.TailscaleIPs) == 0 && len(peer.TailscaleIPs) > 0 {
+			qlog.Info("Peer matched but all its IPs are filtered by -exclude-ips/-include-only-ips", "peer", peer.DNSName)
+			return
+		}
+	}
+	t := s.ipType
+	if override, ok := s.ipTypes.lookup(peer.DNSName); ok {
+		t = override
+	}
+	start := len(m.Answer)
+	addPeerToAnswer(q, m, filtered, *ttl, t, qlog)
+	m.Answer = append(m.Answer[:start], selectAddresses(m.Answer[start:], s.ipSelect)...)
+}
+
+// ipAllowed reports whether addr may be returned in answers under the
+// -exclude-ips and -include-only-ips filters.
+func (s *DNSServer) ipAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range s.excludeIPs {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(s.includeIPs) == 0 {
+		return true
+	}
+	for _, p := range s.includeIPs {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// addPeerToAnswer adds appropriate resource records for a peer to the DNS
+// answer, if its address type ipType allows the query type
+func addPeerToAnswer(q dns.Question, m *dns.Msg, peer ipnstate.PeerStatus, ttl int, ipType string, qlog *slog.Logger) {
+	if len(peer.TailscaleIPs) == 0 {
+		qlog.Info("Peer matched but has no IPs", "peer", peer.DNSName)
+		return
+	}
+	if !ipTypeAllows(ipType, q.Qtype) {
+		qlog.Info("Peer matched but is answered with one address type only", "peer", peer.DNSName, "ip_type", ipType)
+		return
+	}
+	qlog.Info("Found match", "name", q.Name, "ips", peer.TailscaleIPs)
+
+	// Skip repeated addresses, which would otherwise be answered as
+	// duplicate records (RFC 2181 section 5)
+	seenIPs := make(map[netip.Addr]bool)
+	hasIPv6 := false
 	for _, addr := range peer.TailscaleIPs {
+		// IPv4-mapped IPv6 addresses are IPv4 addresses; Is6 is also
+		// true for them, so unmap before choosing the record type
+		addr = addr.Unmap()
+		if seenIPs[addr] {
+			continue
+		}
+		seenIPs[addr] = true
+		hasIPv6 = hasIPv6 || addr.Is6()
 		// Only return the appropriate address type
 		if (q.Qtype == dns.TypeA && addr.Is4()) || (q.Qtype == dns.TypeAAAA && addr.Is6()) {
 			rr := createRR(q.Name, addr, ttl)
@@ -219,42 +1247,58 @@ func addPeerToAnswer(q dns.Question, m *dns.Msg, peer ipnstate.PeerStatus, ttl i
 			}
 		}
 	}
+
+	// Synthesize an AAAA record for IPv4-only peers from their mapped
+	// Tailscale IPv6 address, with a shorter TTL since it is computed
+	if q.Qtype == dns.TypeAAAA && !hasIPv6 {
+		for _, addr := range peer.TailscaleIPs {
+			if v6 := mapIPv4ToTailscaleIPv6(addr.Unmap()); v6.IsValid() && !seenIPs[v6] {
+				seenIPs[v6] = true
+				m.Answer = append(m.Answer, createRR(q.Name, v6, ttl/2))
+			}
+		}
+	}
+}
+
+// mapIPv4ToTailscaleIPv6 returns the Tailscale IPv6 address that maps 1:1
+// to the Tailscale IPv4 address v4, or the zero Addr if v4 is not one.
+func mapIPv4ToTailscaleIPv6(v4 netip.Addr) netip.Addr {
+	return tsaddr.Tailscale4To6(v4)
+}
+
+// statusUnavailable answers SERVFAIL for a query that needs the peer list
+// when tailscaled cannot be asked for it.
+func statusUnavailable(m *dns.Msg) {
+	m.Rcode = dns.RcodeServerFailure
+	addExtendedError(m, dns.ExtendedErrorCodeNoReachableAuthority, "cannot get the tailnet status")
 }
 
 // handlePTRQuery handles PTR queries (reverse lookups)
-func (s *DNSServer) handlePTRQuery(q dns.Question, m *dns.Msg) {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	
-	lc, err := s.tsnet.LocalClient()
+func (s *DNSServer) handlePTRQuery(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	status, err := s.fetchStatus()
 	if err != nil {
-		log.Printf("Error getting local client: %v", err)
-		return
-	}
-	
-	status, err := lc.Status(ctx)
-	if err != nil {
-		log.Printf("Error getting status: %v", err)
+		qlog.Error("Error getting status", "err", err)
+		statusUnavailable(m)
 		return
 	}
 
 	// Convert PTR query format (e.g., 1.2.3.4.in-addr.arpa) to IP address
 	ip := extractIPFromReverseDNS(q.Name)
 	if ip == (netip.Addr{}) {
-		log.Printf("Invalid PTR query format: %s", q.Name)
+		qlog.Info("Invalid PTR query format", "name", q.Name)
 		return
 	}
-	
-	log.Printf("PTR lookup for IP: %s", ip)
 
-	// Search peers for matching IP
-	for _, peer := range status.Peer {
+	qlog.Info("PTR lookup", "ip", ip)
+
+	// Search peers, and this node, for matching IP
+	for _, peer := range peersAndSelf(status) {
 		if peer.DNSName == "" {
 			continue
 		}
-		
+
 		for _, peerAddr := range peer.TailscaleIPs {
-			if peerAddr == ip {
+			if peerAddr.Unmap() == ip {
 				ptr := &dns.PTR{
 					Hdr: dns.RR_Header{
 						Name:   q.Name,
@@ -262,7 +1306,7 @@ func (s *DNSServer) handlePTRQuery(q dns.Question, m *dns.Msg) {
 						Class:  dns.ClassINET,
 						Ttl:    uint32(*ttl),
 					},
-					Ptr: peer.DNSName + ".",
+					Ptr: dns.Fqdn(peer.DNSName),
 				}
 				m.Answer = append(m.Answer, ptr)
 				return
@@ -271,60 +1315,119 @@ func (s *DNSServer) handlePTRQuery(q dns.Question, m *dns.Msg) {
 	}
 }
 
+// handleNSQuery answers NS queries for a configured domain or owned zone
+// with the proxy itself, adding its addresses to the additional section
+func (s *DNSServer) handleNSQuery(q dns.Question, m *dns.Msg) {
+	self := s.status.Load().Self
+	if self == nil || self.DNSName == "" {
+		return
+	}
+
+	for _, d := range slices.Concat(s.domains, s.ownedZones) {
+		if !strings.EqualFold(q.Name, dns.Fqdn(d)) {
+			continue
+		}
+
+		ns := dns.Fqdn(self.DNSName)
+		m.Answer = append(m.Answer, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   q.Name,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    uint32(*ttl),
+			},
+			Ns: ns,
+		})
+		for _, addr := range self.TailscaleIPs {
+			if rr := createRR(ns, addr, *ttl); rr != nil {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+		return
+	}
+}
+
+// extractClientIP returns the IP address of a DNS client from its
+// ResponseWriter's RemoteAddr, for UDP, TCP and TLS connections alike, or
+// the zero Addr if it has none.
+func extractClientIP(addr net.Addr) netip.Addr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	case *net.TCPAddr:
+		ip, _ := netip.AddrFromSlice(a.IP)
+		return ip.Unmap()
+	case nil:
+		return netip.Addr{}
+	}
+	// Other connection types, e.g. a tls.Conn over a wrapped listener,
+	// still report host:port
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}
+	}
+	return ap.Addr().Unmap()
+}
+
 // extractIPFromReverseDNS extracts an IP address from a reverse DNS query
 // e.g., 1.2.3.4.in-addr.arpa -> 4.3.2.1 (IPv4)
 // e.g., 1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa -> 2001:db8::1 (IPv6)
 func extractIPFromReverseDNS(name string) netip.Addr {
 	name = strings.ToLower(name)
-	
+
 	// Handle IPv4
-	if strings.HasSuffix(name, ".in-addr.arpa.") {
-		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa."), ".")
+	if dnsname.HasSuffix(name, "in-addr.arpa") {
+		parts := strings.Split(dnsname.TrimSuffix(name, "in-addr.arpa"), ".")
 		if len(parts) != 4 {
 			return netip.Addr{}
 		}
-		
+
 		// Reverse the order (PTR is in reverse)
 		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
 			parts[i], parts[j] = parts[j], parts[i]
 		}
-		
+
 		ip := strings.Join(parts, ".")
 		if addr, err := netip.ParseAddr(ip); err == nil {
 			return addr
 		}
 	}
-	
-	// Handle IPv6
-	if strings.HasSuffix(name, ".ip6.arpa.") {
-		parts := strings.Split(strings.TrimSuffix(name, ".ip6.arpa."), ".")
-		if len(parts) != 32 {
+
+	// Handle IPv6: the name is the address's 32 nibbles, least
+	// significant first
+	if dnsname.HasSuffix(name, "ip6.arpa") {
+		nibbles := strings.Split(dnsname.TrimSuffix(name, "ip6.arpa"), ".")
+		if len(nibbles) != 32 {
 			return netip.Addr{}
 		}
-		
-		// Reverse and convert to IPv6 hex format
-		var hexParts []string
-		for i := 0; i < 32; i += 4 {
-			if i+4 > len(parts) {
-				break
+		for _, n := range nibbles {
+			if len(n) != 1 || !strings.Contains("0123456789abcdef", n) {
+				// Every label must be exactly one hex digit
+				return netip.Addr{}
 			}
-			
-			// PTR format has each hex digit separated, we need to group them
-			hexPart := parts[i+3] + parts[i+2] + parts[i+1] + parts[i]
-			hexParts = append(hexParts, hexPart)
 		}
-		
-		ip := strings.Join(hexParts, ":")
-		if addr, err := netip.ParseAddr(ip); err == nil {
+		for i, j := 0, len(nibbles)-1; i < j; i, j = i+1, j-1 {
+			nibbles[i], nibbles[j] = nibbles[j], nibbles[i]
+		}
+
+		groups := make([]string, 0, 8)
+		for i := 0; i < len(nibbles); i += 4 {
+			groups = append(groups, strings.Join(nibbles[i:i+4], ""))
+		}
+		if addr, err := netip.ParseAddr(strings.Join(groups, ":")); err == nil {
 			return addr
 		}
 	}
-	
+
 	return netip.Addr{}
 }
 
 // createRR creates a resource record for the given name and IP
 func createRR(name string, ip netip.Addr, ttl int) dns.RR {
+	// IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) are IPv4 addresses and
+	// belong in A records
+	ip = ip.Unmap()
 	if ip.Is4() {
 		return &dns.A{
 			Hdr: dns.RR_Header{
@@ -347,4 +1450,4 @@ func createRR(name string, ip netip.Addr, ttl int) dns.RR {
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
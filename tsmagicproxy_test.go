@@ -0,0 +1,203 @@
+package main
+
+import (
+	"log/slog"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+	"tailscale.com/util/dnsname"
+)
+
+// newTestStatus returns a status with the given self node and peers.
+func newTestStatus(self *ipnstate.PeerStatus, peers ...*ipnstate.PeerStatus) *ipnstate.Status {
+	status := &ipnstate.Status{
+		Self:         self,
+		TailscaleIPs: self.TailscaleIPs,
+		Peer:         make(map[key.NodePublic]*ipnstate.PeerStatus),
+	}
+	for _, peer := range peers {
+		status.Peer[key.NewNode().Public()] = peer
+	}
+	return status
+}
+
+func TestFindPeerSanitizedHostname(t *testing.T) {
+	// tailscaled derives a node's DNS name from its OS hostname the way
+	// SanitizeLabel does, so a peer is found by its sanitized hostname
+	hostnames := []string{"web", "Web-1", "My Laptop", "db_primary", "-edge-"}
+	self := &ipnstate.PeerStatus{
+		DNSName:      "proxy.tail1.ts.net.",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.1")},
+	}
+	var peers []*ipnstate.PeerStatus
+	for i, h := range hostnames {
+		peers = append(peers, &ipnstate.PeerStatus{
+			HostName:     h,
+			DNSName:      dnsname.SanitizeLabel(h) + ".tail1.ts.net.",
+			TailscaleIPs: []netip.Addr{netip.AddrFrom4([4]byte{100, 64, 0, byte(10 + i)})},
+		})
+	}
+	status := newTestStatus(self, peers...)
+	s := &DNSServer{domains: []string{"tail1.ts.net"}, shortNames: conflictPick}
+
+	for i, h := range hostnames {
+		label := dnsname.SanitizeLabel(h)
+		for _, qname := range []string{label, label + ".tail1.ts.net"} {
+			if got := s.findPeer(status, qname, slog.Default()); got != peers[i] {
+				t.Errorf("findPeer(%q) for hostname %q = %v, want %s", qname, h, got, peers[i].DNSName)
+			}
+		}
+	}
+}
+
+func TestCreateRR(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"100.64.0.1", "web.tail1.ts.net.\t60\tIN\tA\t100.64.0.1"},
+		{"::ffff:100.64.0.1", "web.tail1.ts.net.\t60\tIN\tA\t100.64.0.1"},
+		{"fd7a:115c:a1e0::1", "web.tail1.ts.net.\t60\tIN\tAAAA\tfd7a:115c:a1e0::1"},
+	}
+	for _, tt := range tests {
+		rr := createRR("web.tail1.ts.net.", netip.MustParseAddr(tt.ip), 60)
+		if rr == nil || rr.String() != tt.want {
+			t.Errorf("createRR(%s) = %v, want %s", tt.ip, rr, tt.want)
+		}
+	}
+	if rr := createRR("web.tail1.ts.net.", netip.MustParseAddr("::ffff:100.64.0.1"), 60); !isA(rr) {
+		t.Errorf("createRR(::ffff:100.64.0.1) is a %T, want *dns.A", rr)
+	}
+	if rr := createRR("web.tail1.ts.net.", netip.Addr{}, 60); rr != nil {
+		t.Errorf("createRR(invalid) = %v, want nil", rr)
+	}
+}
+
+func isA(rr dns.RR) bool {
+	_, ok := rr.(*dns.A)
+	return ok
+}
+
+func TestHandleDNSRequestNameLength(t *testing.T) {
+	s := newStaticTestServer(t)
+	label63 := strings.Repeat("a", 63)
+	tests := []struct {
+		name  string
+		rcode int
+	}{
+		{label63 + ".tail1.ts.net.", dns.RcodeSuccess},
+		{label63 + "a.tail1.ts.net.", dns.RcodeFormatError},
+		{strings.Repeat(label63+".", 3) + strings.Repeat("a", 61) + ".", dns.RcodeRefused},
+		{strings.Repeat(label63+".", 3) + strings.Repeat("a", 62) + ".", dns.RcodeFormatError},
+		{".", dns.RcodeSuccess},
+		{"", dns.RcodeFormatError},
+	}
+	for _, tt := range tests {
+		if m := query(t, s, tt.name, dns.TypeA); m.Rcode != tt.rcode {
+			t.Errorf("%d-byte name: rcode = %s, want %s", len(tt.name), dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.rcode])
+		}
+	}
+}
+
+func TestSelfShortName(t *testing.T) {
+	s := newStaticTestServer(t)
+	status, err := s.fetchStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		m := query(t, s, "proxy.", qtype)
+		var got []netip.Addr
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, netip.MustParseAddr(rr.A.String()))
+			case *dns.AAAA:
+				got = append(got, netip.MustParseAddr(rr.AAAA.String()))
+			}
+		}
+		want := status.Self.TailscaleIPs[0]
+		if qtype == dns.TypeAAAA {
+			want = status.Self.TailscaleIPs[1]
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Errorf("proxy %s = %v, want %v", dns.TypeToString[qtype], got, want)
+		}
+	}
+}
+
+func TestAddPeerToAnswerDuplicates(t *testing.T) {
+	a1 := netip.MustParseAddr("100.64.0.2")
+	a2 := netip.MustParseAddr("100.64.0.3")
+	tests := []struct {
+		ips  []netip.Addr
+		want int
+	}{
+		{[]netip.Addr{a1, a1, a2}, 2},
+		{[]netip.Addr{a1, netip.MustParseAddr("::ffff:100.64.0.2")}, 1},
+	}
+	q := dns.Question{Name: "web.tail1.ts.net.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for _, tt := range tests {
+		m := new(dns.Msg)
+		peer := ipnstate.PeerStatus{DNSName: "web.tail1.ts.net.", TailscaleIPs: tt.ips}
+		addPeerToAnswer(q, m, peer, 60, "both", slog.Default())
+		if len(m.Answer) != tt.want {
+			t.Errorf("addresses %v gave %d records, want %d: %v", tt.ips, len(m.Answer), tt.want, m.Answer)
+		}
+	}
+}
+
+func TestExtractIPFromReverseDNS(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // empty for the zero Addr
+	}{
+		{"4.3.2.1.in-addr.arpa.", "1.2.3.4"},
+		{"2.0.64.100.IN-ADDR.ARPA", "100.64.0.2"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.", "2001:db8::1"},
+		{"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.0.a.c.5.1.1.a.7.d.f.ip6.arpa.", "fd7a:115c:a0e0::1"},
+		{"F.E.D.C.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.IP6.ARPA", "fd7a:115c:a1e0::cdef"},
+
+		{"3.2.1.in-addr.arpa.", ""},
+		{"256.3.2.1.in-addr.arpa.", ""},
+		{"0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", ""},
+		{"ab.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", ""},
+		{"10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.ip6.arpa.", ""},
+		{"g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.e.1.a.c.5.1.1.a.7.d.f.ip6.arpa.", ""},
+		{"web.tail1.ts.net.", ""},
+	}
+	for _, tt := range tests {
+		got := extractIPFromReverseDNS(tt.name)
+		if tt.want == "" {
+			if got.IsValid() {
+				t.Errorf("extractIPFromReverseDNS(%q) = %v, want none", tt.name, got)
+			}
+			continue
+		}
+		if want := netip.MustParseAddr(tt.want); got != want {
+			t.Errorf("extractIPFromReverseDNS(%q) = %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestHandleDNSRequestOpcode(t *testing.T) {
+	s := newStaticTestServer(t)
+	for _, opcode := range []int{dns.OpcodeStatus, dns.OpcodeNotify, dns.OpcodeUpdate, dns.OpcodeIQuery} {
+		r := new(dns.Msg)
+		r.SetQuestion("web.tail1.ts.net.", dns.TypeA)
+		r.Opcode = opcode
+		w := &captureWriter{}
+		s.handleDNSRequest(w, r)
+		if w.msg == nil {
+			t.Fatalf("opcode %s: no response", dns.OpcodeToString[opcode])
+		}
+		if w.msg.Rcode != dns.RcodeNotImplemented || w.msg.Opcode != opcode || len(w.msg.Answer) != 0 {
+			t.Errorf("opcode %s: got rcode %s, opcode %s, %d answers; want NOTIMP with the same opcode and no answers",
+				dns.OpcodeToString[opcode], dns.RcodeToString[w.msg.Rcode], dns.OpcodeToString[w.msg.Opcode], len(w.msg.Answer))
+		}
+	}
+}
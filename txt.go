@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/util/dnsname"
+)
+
+// handleTXTQuery handles TXT queries for the features that publish data as
+// TXT records. Funnel URLs are public and always answered; the others are
+// off unless enabled by their flag.
+func (s *DNSServer) handleTXTQuery(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	if *exposeConfigDNS && s.isConfigName(q.Name) {
+		s.addConfigTXT(q, m)
+		return
+	}
+	if name, ok := strings.CutPrefix(strings.ToLower(q.Name), "_funnel."); ok {
+		s.addFunnelTXT(q, m, dnsname.TrimSuffix(name, "."))
+		return
+	}
+	if *useNodeAttrs {
+		s.addNodeAttrTXT(q, m, qlog)
+	}
+	if *exitNodeRecords {
+		s.addExitNodeTXT(q, m, qlog)
+	}
+}
+
+// isConfigName reports whether name is _config.<domain> for a configured
+// domain.
+func (s *DNSServer) isConfigName(name string) bool {
+	for _, d := range s.domains {
+		if strings.EqualFold(name, "_config."+dns.Fqdn(d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// addConfigTXT answers _config.<domain> with a subset of the runtime
+// configuration, one record per key.
+func (s *DNSServer) addConfigTXT(q dns.Question, m *dns.Msg) {
+	status, err := s.fetchStatus()
+	if err != nil {
+		log.Printf("Error getting status: %v", err)
+		return
+	}
+	for _, txt := range []string{
+		"version=" + version,
+		"domain=" + s.domain,
+		fmt.Sprintf("uptime=%d", int64(time.Since(startTime).Seconds())),
+		fmt.Sprintf("peers=%d", len(status.Peer)),
+	} {
+		m.Answer = append(m.Answer, txtRR(q.Name, 0, txt))
+	}
+}
+
+// addExitNodeTXT answers a TXT query for an exit node peer with the external
+// IP of its current direct WireGuard endpoint. Peers reached over DERP have
+// no known external IP and get no record, and neither do peers reached
+// directly on a LAN or through a carrier NAT, whose endpoint is not one
+// the internet sees.
+func (s *DNSServer) addExitNodeTXT(q dns.Question, m *dns.Msg, qlog *slog.Logger) {
+	status, err := s.fetchStatus()
+	if err != nil {
+		qlog.Error("Error getting status", "err", err)
+		return
+	}
+	peer := s.findPeer(status, dnsname.TrimSuffix(q.Name, "."), qlog)
+	if peer == nil || !peer.ExitNodeOption || peer.CurAddr == "" {
+		return
+	}
+	endpoint, err := netip.ParseAddrPort(peer.CurAddr)
+	if err != nil {
+		qlog.Warn("Invalid exit node endpoint", "peer", peer.DNSName, "endpoint", peer.CurAddr, "err", err)
+		return
+	}
+	ip := endpoint.Addr().Unmap()
+	if !isPublicIP(ip) {
+		if s.debug {
+			qlog.Info("Not publishing non-public exit node endpoint", "peer", peer.DNSName, "ip", ip)
+		}
+		return
+	}
+	m.Answer = append(m.Answer, txtRR(q.Name, uint32(*ttl), "exit-node-ip="+ip.String()))
+}
+
+// isPublicIP reports whether ip is a global unicast address outside the
+// private, unique local and shared (100.64.0.0/10) ranges.
+func isPublicIP(ip netip.Addr) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !tsaddr.CGNATRange().Contains(ip)
+}
+
+// addFunnelTXT answers _funnel.<name> with the public URLs of the peer's
+// Tailscale Funnel services. Only this node's serve config is visible, so
+// other peers are answered from -funnel-record.
+func (s *DNSServer) addFunnelTXT(q dns.Question, m *dns.Msg, name string) {
+	if _, u, ok := funnelRecordFlags.lookup(name); ok {
+		m.Answer = append(m.Answer, txtRR(q.Name, uint32(*ttl), "url="+u))
+		return
+	}
+
+	status, err := s.fetchStatus()
+	if err != nil {
+		log.Printf("Error getting status: %v", err)
+		return
+	}
+	// Without a tailnet connection only -funnel-record URLs are known
+	if s.tsnet == nil || !s.isSelf(status, name) {
+		return
+	}
+	sc, err := s.serveConfig()
+	if err != nil {
+		log.Printf("Error getting serve config: %v", err)
+		return
+	}
+
+	var urls []string
+	for hp, on := range sc.AllowFunnel {
+		host, port, err := net.SplitHostPort(string(hp))
+		if !on || err != nil {
+			continue
+		}
+		u := "https://" + host
+		if port != "443" {
+			u += ":" + port
+		}
+		urls = append(urls, u)
+	}
+	slices.Sort(urls)
+	for _, u := range urls {
+		m.Answer = append(m.Answer, txtRR(q.Name, uint32(*ttl), "url="+u))
+	}
+}
+
+// txtRR returns a TXT record holding a single string.
+func txtRR(name string, ttl uint32, txt string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeTXT,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Txt: []string{txt},
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"203.0.113.7", true},
+		{"2001:db8::7", true},
+		{"10.0.0.7", false},
+		{"192.168.1.7", false},
+		{"127.0.0.1", false},
+		{"169.254.0.7", false},
+		{"100.64.0.7", false},
+		{"100.127.255.254", false},
+		{"fd7a:115c:a1e0::7", false},
+		{"fe80::7", false},
+		{"::1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// typeUpstreamFlags collects the -type-upstream flags.
+var typeUpstreamFlags = typeUpstreams{}
+
+// typeUpstreams maps a query type to the comma-separated upstreams, in the
+// -upstream syntax, that forwarded queries of that type go to instead of
+// -upstream. It implements flag.Value for -type-upstream.
+type typeUpstreams map[uint16]string
+
+func (t typeUpstreams) String() string {
+	var entries []string
+	for qtype, upstreams := range t {
+		entries = append(entries, dns.TypeToString[qtype]+"="+upstreams)
+	}
+	slices.Sort(entries)
+	return strings.Join(entries, " ")
+}
+
+// Set parses an entry of the form TYPE=upstream[,upstream...].
+func (t typeUpstreams) Set(v string) error {
+	name, upstreams, ok := strings.Cut(v, "=")
+	if !ok || upstreams == "" {
+		return fmt.Errorf("%q is not of the form TYPE=upstream", v)
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+	if !ok {
+		return fmt.Errorf("unknown record type %q", name)
+	}
+	addrs, _ := parseUpstreams(upstreams, false)
+	for _, addr := range addrs {
+		if err := validateUpstream(addr); err != nil {
+			return err
+		}
+	}
+	t[qtype] = upstreams
+	return nil
+}
+
+// parse returns the upstreams for each query type and the DNS-over-TLS
+// server names of those that use TLS, as parseUpstreams does for -upstream.
+func (t typeUpstreams) parse(allTLS bool) (addrs map[uint16][]string, tlsNames map[string]string) {
+	addrs = make(map[uint16][]string, len(t))
+	tlsNames = make(map[string]string)
+	for qtype, upstreams := range t {
+		var names map[string]string
+		addrs[qtype], names = parseUpstreams(upstreams, allTLS)
+		maps.Copy(tlsNames, names)
+	}
+	return addrs, tlsNames
+}
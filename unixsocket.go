@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// unixDatagramSuffix names the datagram socket served beside the stream
+// socket at -unix-socket, as both cannot share one path.
+const unixDatagramSuffix = ".dgram"
+
+// parseSocketMode parses an octal file mode such as 0660.
+func parseSocketMode(v string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("%q is not an octal file mode", v)
+	}
+	return os.FileMode(mode), nil
+}
+
+// ServeUnix serves DNS on Unix domain sockets for clients sharing the
+// host, such as sidecar containers: over a stream socket at path, framed
+// like TCP, and a datagram socket at path plus unixDatagramSuffix, with
+// one message per datagram like UDP. Both sockets get mode.
+func (s *DNSServer) ServeUnix(path string, mode os.FileMode) {
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, r *dns.Msg) {
+		s.handleDNSRequest(unixWriter{w}, r)
+	})
+
+	dgramPath := path + unixDatagramSuffix
+	os.Remove(path)
+	os.Remove(dgramPath)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", path, err)
+	}
+	pc, err := net.ListenPacket("unixgram", dgramPath)
+	if err != nil {
+		log.Fatalf("Error listening on %s: %v", dgramPath, err)
+	}
+	for _, p := range []string{path, dgramPath} {
+		if err := os.Chmod(p, mode); err != nil {
+			log.Fatalf("Error setting permissions of %s: %v", p, err)
+		}
+	}
+
+	log.Printf("Serving DNS on Unix sockets %s and %s", path, dgramPath)
+	errc := make(chan error)
+	for _, server := range []*dns.Server{
+		{PacketConn: unixPacketConn{pc}, Handler: mux},
+		{Listener: ln, Handler: mux},
+	} {
+		s.trackServer(server)
+		go func() { errc <- server.ActivateAndServe() }()
+	}
+	s.serveUntilError(errc)
+}
+
+// unixPacketConn drops datagrams from clients whose socket is not bound to
+// a path. They cannot be answered, and the DNS library panics on a message
+// without a sender address.
+type unixPacketConn struct {
+	net.PacketConn
+}
+
+func (c unixPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || addr != nil {
+			return n, addr, err
+		}
+	}
+}
+
+// unixWriter reports an unnamed Unix socket peer when the connection has no
+// remote address, so handlers never see a nil one.
+type unixWriter struct {
+	dns.ResponseWriter
+}
+
+func (w unixWriter) RemoteAddr() net.Addr {
+	if addr := w.ResponseWriter.RemoteAddr(); addr != nil {
+		return addr
+	}
+	return &net.UnixAddr{Net: "unix"}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tailscale.com/ipn"
+)
+
+// watchRetryInterval is how long to wait before watching the IPN bus again
+// after the watch fails.
+const watchRetryInterval = 5 * time.Second
+
+// statusUpdates tells subscribers when the stored status has been replaced
+// by a newer one from tailscaled or -static-peers-file.
+type statusUpdates struct {
+	mu   sync.Mutex
+	subs []chan struct{}
+}
+
+// subscribe returns a channel that receives a value after each update.
+// Updates made while one is still pending are coalesced, so a slow
+// subscriber catches up with the latest status rather than seeing each.
+func (u *statusUpdates) subscribe() <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.subs = append(u.subs, ch)
+	return ch
+}
+
+// publish notifies every subscriber without waiting for any of them.
+func (u *statusUpdates) publish() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, ch := range u.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchPeers refreshes the stored status whenever tailscaled reports a new
+// network map, so queries, zone NOTIFYs, zone files and departure tracking
+// see peer changes as they happen without polling tailscaled. It also
+// refreshes on engine updates, which carry no network map but change the
+// peers' WireGuard endpoints and connection state.
+func (s *DNSServer) watchPeers() {
+	for ; ; time.Sleep(watchRetryInterval) {
+		if err := s.watchIPNBus(); err != nil {
+			log.Printf("Error watching tailnet changes: %v", err)
+		}
+	}
+}
+
+// watchIPNBus reads network map and engine updates from the IPN bus until
+// it fails.
+// While it reads them, fetchStatus returns the stored status instead of
+// asking tailscaled.
+func (s *DNSServer) watchIPNBus() error {
+	lc, err := s.tsnet.LocalClient()
+	if err != nil {
+		return fmt.Errorf("getting local client: %w", err)
+	}
+	// The initial network map catches up with changes made while the bus
+	// was not being watched. Rate limiting keeps engine updates, which
+	// follow traffic, to one every few seconds.
+	w, err := lc.WatchIPNBus(context.Background(),
+		ipn.NotifyInitialNetMap|ipn.NotifyWatchEngineUpdates|ipn.NotifyNoPrivateKeys|ipn.NotifyRateLimit)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	defer s.watching.Store(false)
+
+	for {
+		n, err := w.Next()
+		if err != nil {
+			return err
+		}
+		if n.NetMap == nil && n.Engine == nil {
+			continue
+		}
+		received := time.Now()
+		if _, err := s.queryStatus(); err != nil {
+			log.Printf("Error getting status after tailnet update: %v", err)
+			s.watching.Store(false)
+			continue
+		}
+		if n.NetMap != nil {
+			metricPeerUpdateLatency.Observe(time.Since(received).Seconds())
+		}
+		s.watching.Store(true)
+		s.updates.publish()
+		if s.debug && n.NetMap != nil {
+			log.Printf("Network map updated, %d peers", len(n.NetMap.Peers))
+		}
+	}
+}
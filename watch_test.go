@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestStatusUpdatesCoalesce(t *testing.T) {
+	var u statusUpdates
+	a, b := u.subscribe(), u.subscribe()
+	u.publish()
+	u.publish() // coalesced with the pending update
+	for _, ch := range []<-chan struct{}{a, b} {
+		select {
+		case <-ch:
+		default:
+			t.Fatal("subscriber was not notified")
+		}
+		select {
+		case <-ch:
+			t.Fatal("pending updates were not coalesced")
+		default:
+		}
+	}
+}
+
+func TestZoneFileFollowsUpdates(t *testing.T) {
+	s := newStaticTestServer(t)
+	path := filepath.Join(t.TempDir(), "tail1.zone")
+	go s.writeZoneFiles(path, "bind")
+
+	waitForZone := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			data, _ := os.ReadFile(path)
+			if strings.Contains(string(data), want) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("zone file never contained %q, last read:\n%s", want, data)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	waitForZone("web.tail1.ts.net.")
+
+	// A new peer is written out on the next update, without polling
+	status := *s.status.Load()
+	status.Peer = make(map[key.NodePublic]*ipnstate.PeerStatus)
+	for k, v := range s.status.Load().Peer {
+		status.Peer[k] = v
+	}
+	status.Peer[key.NewNode().Public()] = &ipnstate.PeerStatus{
+		DNSName:      "new.tail1.ts.net.",
+		TailscaleIPs: []netip.Addr{netip.MustParseAddr("100.64.0.4")},
+	}
+	s.status.Store(&status)
+	s.updates.publish()
+	waitForZone("new.tail1.ts.net.")
+}
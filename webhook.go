@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/util/dnsname"
+)
+
+// Peer lifecycle events sent to -webhook-url.
+const (
+	eventPeerJoined    = "peer_joined"
+	eventPeerLeft      = "peer_left"
+	eventPeerIPChanged = "peer_ip_changed"
+)
+
+const (
+	// webhookRetries is how many times a failed delivery is retried.
+	webhookRetries = 3
+
+	// webhookQueueSize bounds the events waiting for delivery to one URL;
+	// events beyond it are dropped and counted as failures.
+	webhookQueueSize = 256
+)
+
+// webhookBackoff is the wait before the first retry of a delivery, doubled
+// for each retry after it. It is a variable so tests can shorten it.
+var webhookBackoff = time.Second
+
+// webhookURLFlags collects the -webhook-url flags.
+var webhookURLFlags = webhookURLs{}
+
+// webhookURLs implements flag.Value for the repeatable -webhook-url flag.
+type webhookURLs []string
+
+func (w *webhookURLs) String() string {
+	return strings.Join(*w, ",")
+}
+
+// Set parses one http or https URL.
+func (w *webhookURLs) Set(v string) error {
+	u, err := url.Parse(v)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("URL %q must be an http or https URL", v)
+	}
+	*w = append(*w, v)
+	return nil
+}
+
+// redactWebhookURL redacts u for logs and the configuration summary.
+// Webhook services often put their token in the path, so unlike
+// redactURLs it redacts the path too.
+func redactWebhookURL(u string) string {
+	parsed, err := url.Parse(redactURLs(u))
+	if err != nil {
+		return "<redacted>"
+	}
+	if parsed.Path != "" && parsed.Path != "/" {
+		parsed.Path = "/redacted"
+	}
+	return parsed.String()
+}
+
+// parseWebhookEvents parses the comma-separated -webhook-events list.
+func parseWebhookEvents(list string) (map[string]bool, error) {
+	events := make(map[string]bool)
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		switch e {
+		case "":
+		case eventPeerJoined, eventPeerLeft, eventPeerIPChanged:
+			events[e] = true
+		default:
+			return nil, fmt.Errorf("unknown event %q, must be %s, %s or %s", e, eventPeerJoined, eventPeerLeft, eventPeerIPChanged)
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no events given")
+	}
+	return events, nil
+}
+
+// webhookEvent is the JSON body POSTed for one peer lifecycle event.
+type webhookEvent struct {
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Peer  webhookPeer `json:"peer"`
+}
+
+// webhookPeer describes the peer an event is about. PreviousIPs is only set
+// for peer_ip_changed.
+type webhookPeer struct {
+	Name        string       `json:"name"`
+	HostName    string       `json:"hostname,omitempty"`
+	OS          string       `json:"os,omitempty"`
+	IPs         []netip.Addr `json:"ips"`
+	PreviousIPs []netip.Addr `json:"previous_ips,omitempty"`
+}
+
+// webhookNotifier compares each status with the last one, like
+// departureTracker, and sends an event to every -webhook-url for each
+// peer that joined, left or changed IPs.
+type webhookNotifier struct {
+	events  map[string]bool
+	timeout time.Duration
+	queues  map[string]chan []byte // event bodies waiting, by URL
+
+	peers map[string]webhookPeer // peers in the last status, nil until the first
+}
+
+func newWebhookNotifier(urls []string, events map[string]bool, timeout time.Duration) *webhookNotifier {
+	w := &webhookNotifier{
+		events:  events,
+		timeout: timeout,
+		queues:  make(map[string]chan []byte),
+	}
+	for _, u := range urls {
+		w.queues[u] = make(chan []byte, webhookQueueSize)
+	}
+	return w
+}
+
+// run delivers events to each URL in order, and compares every status
+// update with the last until the process exits.
+func (w *webhookNotifier) run(s *DNSServer) {
+	for u, queue := range w.queues {
+		go w.deliverAll(u, queue)
+	}
+	for range s.updates.subscribe() {
+		w.observe(s.status.Load())
+	}
+}
+
+// observe queues an event for each difference between status and the last
+// status observed. The first status observed only sets the baseline, so
+// peers already in the tailnet at startup are not reported as joining.
+func (w *webhookNotifier) observe(status *ipnstate.Status) {
+	now := time.Now()
+	peers := make(map[string]webhookPeer, len(status.Peer))
+	for _, peer := range status.Peer {
+		if peer.DNSName == "" {
+			continue
+		}
+		name := strings.ToLower(dnsname.TrimSuffix(peer.DNSName, "."))
+		ips := slices.Clone(peer.TailscaleIPs)
+		slices.SortFunc(ips, netip.Addr.Compare)
+		peers[name] = webhookPeer{Name: name, HostName: peer.HostName, OS: peer.OS, IPs: ips}
+	}
+
+	last := w.peers
+	w.peers = peers
+	if last == nil {
+		return
+	}
+	for name, peer := range peers {
+		prev, ok := last[name]
+		switch {
+		case !ok:
+			w.send(webhookEvent{Event: eventPeerJoined, Time: now, Peer: peer})
+		case !slices.Equal(prev.IPs, peer.IPs):
+			peer.PreviousIPs = prev.IPs
+			w.send(webhookEvent{Event: eventPeerIPChanged, Time: now, Peer: peer})
+		}
+	}
+	for name, peer := range last {
+		if _, ok := peers[name]; !ok {
+			w.send(webhookEvent{Event: eventPeerLeft, Time: now, Peer: peer})
+		}
+	}
+}
+
+// send queues e for every URL if its event type is enabled.
+func (w *webhookNotifier) send(e webhookEvent) {
+	if !w.events[e.Event] {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Error encoding %s webhook for %s: %v", e.Event, e.Peer.Name, err)
+		return
+	}
+	for u, queue := range w.queues {
+		select {
+		case queue <- body:
+		default:
+			metricWebhookFailures.Add(1)
+			log.Printf("Webhook queue for %s is full, dropping %s event for %s", redactWebhookURL(u), e.Event, e.Peer.Name)
+		}
+	}
+}
+
+// deliverAll posts each body queued for u in turn, retrying failures.
+func (w *webhookNotifier) deliverAll(u string, queue <-chan []byte) {
+	for body := range queue {
+		var err error
+		for attempt := 0; attempt <= webhookRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(webhookBackoff << (attempt - 1))
+			}
+			if err = w.post(u, body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			metricWebhookFailures.Add(1)
+			log.Printf("Webhook to %s failed after %d attempts: %v", redactWebhookURL(u), webhookRetries+1, err)
+		}
+	}
+}
+
+// post sends one event body to u and fails unless it answers with a 2xx
+// status.
+func (w *webhookNotifier) post(u string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "tsmagicproxy/"+version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Client errors include the URL, which may carry a token
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			uerr.URL = redactWebhookURL(u)
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("server answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+//go:embed webui
+var webuiFiles embed.FS
+
+// peerInfo is a peer as listed by /api/peers.
+type peerInfo struct {
+	DNSName  string       `json:"dnsName"`
+	IPs      []netip.Addr `json:"ips"`
+	Online   bool         `json:"online"`
+	OS       string       `json:"os"`
+	LastSeen *time.Time   `json:"lastSeen,omitempty"`
+}
+
+// serveWebUI serves the peer table web UI and its API on addr. It listens
+// on the tailnet only, so the UI is never exposed on the host's own
+// interfaces.
+func (s *DNSServer) serveWebUI(addr string) {
+	ln, err := s.tsnet.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Error listening for web UI on %s: %v", addr, err)
+	}
+
+	static, _ := fs.Sub(webuiFiles, "webui")
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServerFS(static))
+	mux.HandleFunc("GET /api/peers", s.handleAPIPeers)
+	mux.HandleFunc("GET /api/peers/search", s.handleAPIPeersSearch)
+	mux.HandleFunc("GET /api/version", handleAPIVersion)
+
+	log.Printf("Serving web UI on tailnet address %s", addr)
+	log.Fatal(http.Serve(ln, mux))
+}
+
+// handleAPIPeers returns every peer as JSON, sorted by DNS name.
+func (s *DNSServer) handleAPIPeers(w http.ResponseWriter, r *http.Request) {
+	status, err := s.fetchStatus()
+	if err != nil {
+		log.Printf("Error getting status: %v", err)
+		http.Error(w, "tailnet status unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, peerInfos(status))
+}
+
+// handleAPIPeersSearch returns the peers whose DNS name contains the name
+// parameter (case-insensitively) or that have an IP containing the ip
+// parameter, at most limit of them. It searches the last status fetched
+// rather than querying tailscaled, so it is cheap to poll.
+func (s *DNSServer) handleAPIPeersSearch(w http.ResponseWriter, r *http.Request) {
+	status := s.status.Load()
+	if status == nil {
+		http.Error(w, "not connected to tailnet", http.StatusServiceUnavailable)
+		return
+	}
+
+	name := strings.ToLower(r.URL.Query().Get("name"))
+	ip := r.URL.Query().Get("ip")
+	limit := -1
+	if l := r.URL.Query().Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	matches := []peerInfo{}
+	for _, info := range peerInfos(status) {
+		if limit >= 0 && len(matches) == limit {
+			break
+		}
+		if peerMatches(info, name, ip) {
+			matches = append(matches, info)
+		}
+	}
+	writeJSON(w, matches)
+}
+
+// peerMatches reports whether info matches a search by name substring or IP
+// substring. Empty terms are ignored, and a search with none matches all.
+func peerMatches(info peerInfo, name, ip string) bool {
+	if name == "" && ip == "" {
+		return true
+	}
+	if name != "" && strings.Contains(strings.ToLower(info.DNSName), name) {
+		return true
+	}
+	if ip != "" {
+		for _, addr := range info.IPs {
+			if strings.Contains(addr.String(), ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// peerInfos lists the peers in status, sorted by DNS name.
+func peerInfos(status *ipnstate.Status) []peerInfo {
+	peers := make([]peerInfo, 0, len(status.Peer))
+	for _, peer := range status.Peer {
+		info := peerInfo{
+			DNSName: strings.TrimSuffix(peer.DNSName, "."),
+			IPs:     peer.TailscaleIPs,
+			Online:  peer.Online,
+			OS:      peer.OS,
+		}
+		if !peer.LastSeen.IsZero() {
+			info.LastSeen = &peer.LastSeen
+		}
+		peers = append(peers, info)
+	}
+	slices.SortFunc(peers, func(a, b peerInfo) int {
+		return strings.Compare(a.DNSName, b.DNSName)
+	})
+	return peers
+}
+
+// handleAPIVersion returns the build information of the running binary.
+func handleAPIVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_date": buildDate,
+		"go_version": runtime.Version(),
+	})
+}
+
+// writeJSON writes v as a JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// weightedRecordFlags collects the -weighted-record flags.
+var weightedRecordFlags = weightedRecords{}
+
+// weightedTarget is a peer name and its relative selection weight.
+type weightedTarget struct {
+	peer   string
+	weight int
+}
+
+// weightedRecords maps a lowercase query name, without trailing dot, to the
+// peers it may resolve to. It implements flag.Value for -weighted-record.
+type weightedRecords map[string][]weightedTarget
+
+func (w weightedRecords) String() string {
+	names := make([]string, 0, len(w))
+	for name := range w {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var records []string
+	for _, name := range names {
+		var targets []string
+		for _, t := range w[name] {
+			targets = append(targets, fmt.Sprintf("%s:%d", t.peer, t.weight))
+		}
+		records = append(records, name+"="+strings.Join(targets, ","))
+	}
+	return strings.Join(records, " ")
+}
+
+// Set parses a record of the form name=peer:weight,peer:weight.
+func (w weightedRecords) Set(v string) error {
+	name, list, ok := strings.Cut(v, "=")
+	name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+	if !ok || name == "" {
+		return fmt.Errorf("%q is not of the form name=peer:weight,...", v)
+	}
+
+	var targets []weightedTarget
+	for _, entry := range splitList(list) {
+		peer, weightStr, ok := strings.Cut(entry, ":")
+		if !ok || peer == "" {
+			return fmt.Errorf("%q is not of the form peer:weight", entry)
+		}
+		weight, err := strconv.Atoi(weightStr)
+		if err != nil || weight <= 0 {
+			return fmt.Errorf("weight %q for %s must be a positive integer", weightStr, peer)
+		}
+		targets = append(targets, weightedTarget{strings.TrimSuffix(peer, "."), weight})
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("weighted record %s has no peers", name)
+	}
+	w[name] = targets
+	return nil
+}
+
+// pickWeighted chooses a peer name from targets with probability
+// proportional to its weight. The math/rand/v2 top-level generator is
+// seeded from the OS entropy source and safe for concurrent use, so the
+// choice is independent per query and not predictable across queries.
+func pickWeighted(targets []weightedTarget) string {
+	total := 0
+	for _, t := range targets {
+		total += t.weight
+	}
+	n := rand.IntN(total)
+	for _, t := range targets {
+		if n < t.weight {
+			return t.peer
+		}
+		n -= t.weight
+	}
+	return targets[len(targets)-1].peer
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// zoneFileRecord is one record of a -zone-file-format json zone file.
+type zoneFileRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// zoneFileJSON is a -zone-file-format json zone file.
+type zoneFileJSON struct {
+	Zone    string           `json:"zone"`
+	Serial  uint32           `json:"serial"`
+	Records []zoneFileRecord `json:"records"`
+}
+
+// writeZoneFiles rewrites path in format whenever a status update advances
+// the tailnet zone's SOA serial, and once at startup, for secondaries that
+// load the zone from a file rather than by zone transfer.
+func (s *DNSServer) writeZoneFiles(path, format string) {
+	if s.domain == "" {
+		log.Printf("No domain configured or detected, not writing zone file")
+		return
+	}
+	updates := s.updates.subscribe()
+	var last uint32
+	for ; ; <-updates {
+		status := s.status.Load()
+		records := zoneRecords(status, s.domain, *ttl)
+		soa := s.soaRecord(status, records)
+		if soa.Serial == last {
+			continue
+		}
+		if err := writeZoneFile(path, format, zoneContents(soa, records)); err != nil {
+			log.Printf("Error writing zone file %s: %v", path, err)
+			continue
+		}
+		last = soa.Serial
+		log.Printf("Wrote zone %s at serial %d to %s", soa.Hdr.Name, soa.Serial, path)
+	}
+}
+
+// writeZoneFile replaces path with rrs in format, writing a temporary file
+// first so readers never see a partial zone.
+func writeZoneFile(path, format string, rrs []dns.RR) error {
+	var buf bytes.Buffer
+	soa := rrs[0].(*dns.SOA)
+	switch format {
+	case "json":
+		zone := zoneFileJSON{Zone: soa.Hdr.Name, Serial: soa.Serial}
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			zone.Records = append(zone.Records, zoneFileRecord{
+				Name: hdr.Name,
+				Type: dns.TypeToString[hdr.Rrtype],
+				TTL:  hdr.Ttl,
+				Data: strings.TrimPrefix(rr.String(), hdr.String()),
+			})
+		}
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(zone); err != nil {
+			return err
+		}
+	default:
+		fmt.Fprintf(&buf, "; %s serial %d, generated by tsmagicproxy\n", soa.Hdr.Name, soa.Serial)
+		for _, rr := range rrs {
+			fmt.Fprintln(&buf, rr)
+		}
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}